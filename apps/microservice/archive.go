@@ -0,0 +1,180 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"strings"
+)
+
+// ArchiveLimits caps what an uploaded zip may contain before anything in it
+// is extracted. A zero value disables that check. How much the archive may
+// hold in total is the job's limit, JobLimits.MaxUncompressedBytes.
+type ArchiveLimits struct {
+	MaxEntries          int
+	MaxEntryBytes       int64
+	MaxCompressionRatio float64
+}
+
+func DefaultArchiveLimits() ArchiveLimits {
+	return ArchiveLimits{
+		MaxEntries:          10_000,
+		MaxEntryBytes:       1 << 30,
+		MaxCompressionRatio: 100,
+	}
+}
+
+// Entries smaller than this are never rejected for their compression ratio;
+// tiny, highly repetitive files compress extremely well without being bombs.
+const minRatioCheckBytes = 1 << 20
+
+// Rules an archive can be rejected for.
+const (
+	RulePathTraversal    = "path_traversal"
+	RuleSymlink          = "symlink"
+	RuleNestedArchive    = "nested_archive"
+	RuleTooManyEntries   = "too_many_entries"
+	RuleEntryTooLarge    = "entry_too_large"
+	RuleCompressionRatio = "compression_ratio"
+	RuleSizeMismatch     = "size_mismatch"
+)
+
+var nestedArchiveExts = map[string]bool{
+	".zip": true,
+	".gz":  true,
+	".tgz": true,
+	".tar": true,
+	".7z":  true,
+	".rar": true,
+	".bz2": true,
+	".xz":  true,
+}
+
+// ArchiveError reports which safety rule an archive broke, and on which
+// entry.
+type ArchiveError struct {
+	Rule   string
+	Entry  string
+	Detail string
+}
+
+func (e *ArchiveError) Error() string {
+	if e.Entry == "" {
+		return fmt.Sprintf("unsafe archive (%s): %s", e.Rule, e.Detail)
+	}
+
+	return fmt.Sprintf("unsafe archive (%s) at %q: %s", e.Rule, e.Entry, e.Detail)
+}
+
+// CheckArchive validates the archive's directory against limits without
+// decompressing anything. The sizes it looks at are the ones the archive
+// claims; entryLimiter enforces the real ones while extracting.
+func CheckArchive(files []*zip.File, limits ArchiveLimits) error {
+	if limits.MaxEntries > 0 && len(files) > limits.MaxEntries {
+		return &ArchiveError{
+			Rule:   RuleTooManyEntries,
+			Detail: fmt.Sprintf("%d entries, limit is %d", len(files), limits.MaxEntries),
+		}
+	}
+
+	for _, file := range files {
+		if err := checkEntryName(file.Name); err != nil {
+			return err
+		}
+
+		if file.Mode()&os.ModeSymlink != 0 {
+			return &ArchiveError{Rule: RuleSymlink, Entry: file.Name, Detail: "symbolic links are not allowed"}
+		}
+
+		if file.FileInfo().IsDir() {
+			continue
+		}
+
+		if nestedArchiveExts[strings.ToLower(path.Ext(file.Name))] {
+			return &ArchiveError{Rule: RuleNestedArchive, Entry: file.Name, Detail: "archives inside the archive are not allowed"}
+		}
+
+		size := file.UncompressedSize64
+
+		if limits.MaxEntryBytes > 0 && size > uint64(limits.MaxEntryBytes) {
+			return &ArchiveError{
+				Rule:   RuleEntryTooLarge,
+				Entry:  file.Name,
+				Detail: fmt.Sprintf("%d bytes, limit is %d", size, limits.MaxEntryBytes),
+			}
+		}
+
+		if limits.MaxCompressionRatio > 0 && size >= minRatioCheckBytes {
+			ratio := float64(size) / float64(max(file.CompressedSize64, 1))
+			if ratio > limits.MaxCompressionRatio {
+				return &ArchiveError{
+					Rule:   RuleCompressionRatio,
+					Entry:  file.Name,
+					Detail: fmt.Sprintf("compression ratio %.0f, limit is %.0f", ratio, limits.MaxCompressionRatio),
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// claimedSize adds up the uncompressed sizes the archive's directory claims,
+// stopping at the largest int64 rather than overflowing.
+func claimedSize(files []*zip.File) int64 {
+	var total int64
+
+	for _, file := range files {
+		if file.UncompressedSize64 > uint64(math.MaxInt64-total) {
+			return math.MaxInt64
+		}
+
+		total += int64(file.UncompressedSize64)
+	}
+
+	return total
+}
+
+func checkEntryName(name string) error {
+	cleaned := path.Clean(strings.ReplaceAll(name, `\`, "/"))
+
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return &ArchiveError{Rule: RulePathTraversal, Entry: name, Detail: "entry escapes the extraction directory"}
+	}
+
+	return nil
+}
+
+// entryLimiter counts the bytes actually decompressed, since the sizes in a
+// zip's directory can lie. archive/zip itself stops reading an entry past its
+// stated size, which entryReader reports as RuleSizeMismatch.
+type entryLimiter struct {
+	limits ArchiveLimits
+}
+
+func (l *entryLimiter) charge(file *zip.File, written *int64, n int64) error {
+	*written += n
+
+	if l.limits.MaxEntryBytes > 0 && *written > l.limits.MaxEntryBytes {
+		return &ArchiveError{
+			Rule:   RuleEntryTooLarge,
+			Entry:  file.Name,
+			Detail: fmt.Sprintf("more than %d bytes", l.limits.MaxEntryBytes),
+		}
+	}
+
+	if l.limits.MaxCompressionRatio > 0 && *written >= minRatioCheckBytes {
+		ratio := float64(*written) / float64(max(file.CompressedSize64, 1))
+		if ratio > l.limits.MaxCompressionRatio {
+			return &ArchiveError{
+				Rule:   RuleCompressionRatio,
+				Entry:  file.Name,
+				Detail: fmt.Sprintf("compression ratio above %.0f", l.limits.MaxCompressionRatio),
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testHistoryName = SPOTIFY_FOLDER_NAME + "/Streaming_History_Audio_2023.json"
+
+// buildZip writes a zip with whatever build puts in it and returns its path.
+func buildZip(t *testing.T, build func(t *testing.T, w *zip.Writer)) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "archive.zip")
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	w := zip.NewWriter(file)
+	build(t, w)
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func addEntry(t *testing.T, w *zip.Writer, name string, data []byte) {
+	t.Helper()
+
+	entry, err := w.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := entry.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readArchive opens the archive and reads every history file in it to the
+// end, like the parser does.
+func readArchive(path string, limits ArchiveLimits) error {
+	archive, err := ExtractAndFindAudioHistoryFiles(context.Background(), path, limits, nil)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	for _, file := range archive.Files {
+		rc, err := file.Open()
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(io.Discard, rc)
+		rc.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestMaliciousArchives(t *testing.T) {
+	history := []byte(`[]`)
+
+	tests := []struct {
+		name   string
+		limits ArchiveLimits
+		build  func(t *testing.T, w *zip.Writer)
+		rule   string
+	}{
+		{
+			name: "zip bomb",
+			build: func(t *testing.T, w *zip.Writer) {
+				entry, err := w.Create(testHistoryName)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				chunk := bytes.Repeat([]byte{'a'}, 1<<20)
+				for i := 0; i < 200; i++ {
+					if _, err := entry.Write(chunk); err != nil {
+						t.Fatal(err)
+					}
+				}
+			},
+			rule: RuleCompressionRatio,
+		},
+		{
+			name: "path traversal",
+			build: func(t *testing.T, w *zip.Writer) {
+				addEntry(t, w, "../evil.json", history)
+			},
+			rule: RulePathTraversal,
+		},
+		{
+			name: "absolute path",
+			build: func(t *testing.T, w *zip.Writer) {
+				addEntry(t, w, "/etc/evil.json", history)
+			},
+			rule: RulePathTraversal,
+		},
+		{
+			name: "thousands of entries",
+			build: func(t *testing.T, w *zip.Writer) {
+				for i := 0; i <= DefaultArchiveLimits().MaxEntries; i++ {
+					addEntry(t, w, fmt.Sprintf("%s/Streaming_History_Audio_%d.json", SPOTIFY_FOLDER_NAME, i), history)
+				}
+			},
+			rule: RuleTooManyEntries,
+		},
+		{
+			name: "symlink",
+			build: func(t *testing.T, w *zip.Writer) {
+				header := &zip.FileHeader{Name: testHistoryName}
+				header.SetMode(os.ModeSymlink | 0777)
+
+				entry, err := w.CreateHeader(header)
+				if err != nil {
+					t.Fatal(err)
+				}
+				entry.Write([]byte("/etc/passwd"))
+			},
+			rule: RuleSymlink,
+		},
+		{
+			name: "nested zip",
+			build: func(t *testing.T, w *zip.Writer) {
+				addEntry(t, w, testHistoryName, history)
+				addEntry(t, w, SPOTIFY_FOLDER_NAME+"/more.zip", []byte("PK"))
+			},
+			rule: RuleNestedArchive,
+		},
+		{
+			name:   "huge single file",
+			limits: ArchiveLimits{MaxEntryBytes: 1 << 20},
+			build: func(t *testing.T, w *zip.Writer) {
+				data := make([]byte, 2<<20)
+				rand.Read(data)
+				addEntry(t, w, testHistoryName, data)
+			},
+			rule: RuleEntryTooLarge,
+		},
+		{
+			name: "understated sizes",
+			build: func(t *testing.T, w *zip.Writer) {
+				data := bytes.Repeat([]byte(`{"ts":"2023-01-01T00:00:00Z","ms_played":1000},`), 100_000)
+
+				var compressed bytes.Buffer
+				fw, _ := flate.NewWriter(&compressed, flate.DefaultCompression)
+				fw.Write(data)
+				fw.Close()
+
+				// The directory claims a tiny entry, well under every limit.
+				entry, err := w.CreateRaw(&zip.FileHeader{
+					Name:               testHistoryName,
+					Method:             zip.Deflate,
+					CRC32:              crc32.ChecksumIEEE(data),
+					CompressedSize64:   uint64(compressed.Len()),
+					UncompressedSize64: 1000,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				entry.Write(compressed.Bytes())
+			},
+			rule: RuleSizeMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limits := tt.limits
+			if limits == (ArchiveLimits{}) {
+				limits = DefaultArchiveLimits()
+			}
+
+			err := readArchive(buildZip(t, tt.build), limits)
+
+			var archiveErr *ArchiveError
+			if !errors.As(err, &archiveErr) {
+				t.Fatalf("got %v, want an *ArchiveError", err)
+			}
+
+			if archiveErr.Rule != tt.rule {
+				t.Fatalf("rule = %s, want %s (%v)", archiveErr.Rule, tt.rule, err)
+			}
+		})
+	}
+}
+
+func TestCleanArchiveIsAccepted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "export.zip")
+	writeTestExport(t, path, testTracks(100))
+
+	if err := readArchive(path, DefaultArchiveLimits()); err != nil {
+		t.Fatalf("clean export was rejected: %v", err)
+	}
+}
+
+// How much an archive may hold in total is the job's uncompressed limit, so
+// an archive that holds too much fails with that limit's error, before
+// anything is read.
+func TestTooLargeArchiveIsALimitError(t *testing.T) {
+	data := make([]byte, 600<<10)
+	rand.Read(data)
+
+	path := buildZip(t, func(t *testing.T, w *zip.Writer) {
+		addEntry(t, w, testHistoryName, data)
+		addEntry(t, w, SPOTIFY_FOLDER_NAME+"/Streaming_History_Video_2023.json", data)
+	})
+
+	budget := NewJobBudget(JobLimits{MaxUncompressedBytes: 1 << 20})
+	_, err := ExtractAndFindAudioHistoryFiles(context.Background(), path, DefaultArchiveLimits(), budget)
+
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Code != ErrCodeLimitUncompressed {
+		t.Fatalf("got %v, want a %s limit error", err, ErrCodeLimitUncompressed)
+	}
+
+	if budget.uncompressed != 0 {
+		t.Fatalf("charged %d bytes, want the archive rejected before reading it", budget.uncompressed)
+	}
+}
+
+// archive/zip stops at an entry's stated size, so entryLimiter is checked
+// on its own: it must go by the bytes it is charged, not by the directory.
+func TestEntryLimiterChargesRealBytes(t *testing.T) {
+	file := &zip.File{FileHeader: zip.FileHeader{Name: testHistoryName, UncompressedSize64: 1, CompressedSize64: 1}}
+
+	limiter := &entryLimiter{limits: ArchiveLimits{MaxEntryBytes: 10}}
+
+	var written int64
+	if err := limiter.charge(file, &written, 10); err != nil {
+		t.Fatalf("charge within the limit failed: %v", err)
+	}
+
+	err := limiter.charge(file, &written, 1)
+
+	var archiveErr *ArchiveError
+	if !errors.As(err, &archiveErr) || archiveErr.Rule != RuleEntryTooLarge {
+		t.Fatalf("got %v, want %s", err, RuleEntryTooLarge)
+	}
+}
+
+func TestReadingAFileAgainIsNotChargedTwice(t *testing.T) {
+	data := bytes.Repeat([]byte("[]"), 1000)
+	path := buildZip(t, func(t *testing.T, w *zip.Writer) {
+		addEntry(t, w, testHistoryName, data)
+	})
+
+	budget := NewJobBudget(JobLimits{MaxUncompressedBytes: int64(len(data))})
+	archive, err := ExtractAndFindAudioHistoryFiles(context.Background(), path, ArchiveLimits{MaxEntryBytes: int64(len(data))}, budget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	for i := 0; i < 2; i++ {
+		rc, err := archive.Files[0].Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = io.Copy(io.Discard, rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("read %d: %v", i+1, err)
+		}
+	}
+
+	if budget.uncompressed != int64(len(data)) {
+		t.Fatalf("charged %d bytes for two reads of %d", budget.uncompressed, len(data))
+	}
+}
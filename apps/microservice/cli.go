@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// runAnalyze processes an export on disk the same way a job would, without
+// S3 or the HTTP server, and writes the ProcessResult that would have been
+// uploaded:
+//
+//	listening-history analyze --zip export.zip --out result.json
+func runAnalyze(args []string) error {
+	flags := flag.NewFlagSet("analyze", flag.ContinueOnError)
+
+	zipPath := flags.String("zip", "", "path to the exported zip (required)")
+	outPath := flags.String("out", "-", "where to write the result JSON, - for stdout")
+	processID := flags.String("process-id", "", "process id to put in the result, defaults to the zip's name")
+	timezone := flags.String("timezone", "", "IANA timezone to bucket plays in, defaults to UTC")
+	inferTimezone := flags.Bool("infer-timezone", false, "bucket plays in the zone of the country they were streamed from")
+	minMs := flags.Int("min-ms", 0, "minimum ms played for an entry to count as a play")
+	excludeSkipped := flags.Bool("exclude-skipped", false, "don't count entries marked as skipped as plays")
+	excludeReasonEnd := flags.String("exclude-reason-end", "", "comma separated reason_end values that don't count as plays")
+
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+
+	if *zipPath == "" {
+		flags.Usage()
+		return errors.New("--zip is required")
+	}
+
+	if *processID == "" {
+		*processID = strings.TrimSuffix(filepath.Base(*zipPath), filepath.Ext(*zipPath))
+	}
+
+	options := AnalysisOptions{
+		PlayPolicy: PlayPolicy{
+			MinMs:          *minMs,
+			ExcludeSkipped: *excludeSkipped,
+		},
+		Timezone:      *timezone,
+		InferTimezone: *inferTimezone,
+	}
+
+	if *excludeReasonEnd != "" {
+		options.PlayPolicy.ExcludeReasonEnd = strings.Split(*excludeReasonEnd, ",")
+	}
+
+	if err := options.Validate(); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	limits := jobLimitsFromEnv()
+
+	ctx, cancel := limits.WithDeadline(ctx)
+	defer cancel()
+
+	budget := NewJobBudget(limits)
+
+	info, err := os.Stat(*zipPath)
+	if err != nil {
+		return err
+	}
+
+	if err := budget.CheckArchive(info.Size()); err != nil {
+		return err
+	}
+
+	archive, err := ExtractAndFindAudioHistoryFiles(ctx, *zipPath, archiveLimitsFromEnv(), budget)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	result, err := ProcessListeningHistoryFiles(ctx, archive.Files, *processID, options, budget)
+	if err != nil {
+		if cause := context.Cause(ctx); cause != nil {
+			return cause
+		}
+		return err
+	}
+
+	if *outPath == "-" {
+		return writeResult(os.Stdout, result)
+	}
+
+	file, err := os.Create(*outPath)
+	if err != nil {
+		return err
+	}
+
+	if err := writeResult(file, result); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write result: %w", err)
+	}
+
+	return file.Close()
+}
+
+// writeResult writes the result as the same JSON a job uploads, followed by
+// a newline.
+func writeResult(w io.Writer, result *ProcessResult) error {
+	buffered := bufio.NewWriter(w)
+
+	if err := writeJSONStream(buffered, result); err != nil {
+		return err
+	}
+
+	if err := buffered.WriteByte('\n'); err != nil {
+		return err
+	}
+
+	return buffered.Flush()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunAnalyze(t *testing.T) {
+	dir := t.TempDir()
+	zipPath := filepath.Join(dir, "export.zip")
+	outPath := filepath.Join(dir, "result.json")
+
+	// 20 each of 30, 40, 50, 60 and 70 seconds played.
+	writeTestExport(t, zipPath, testTracks(100))
+
+	err := runAnalyze([]string{"--zip", zipPath, "--out", outPath, "--min-ms", "50000", "--timezone", "Asia/Tokyo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result ProcessResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatalf("result isn't JSON: %v", err)
+	}
+
+	if result.ProcessID != "export" {
+		t.Errorf("process id = %q, want the zip's name", result.ProcessID)
+	}
+	if result.PlayPolicy.MinMs != 50_000 || result.TotalTracks != 60 || result.RawTotalTracks != 100 {
+		t.Errorf("min ms %d counted %d of %d plays, want 50000 counting 60 of 100",
+			result.PlayPolicy.MinMs, result.TotalTracks, result.RawTotalTracks)
+	}
+	if result.Timezone != "Asia/Tokyo" {
+		t.Errorf("timezone = %q, want Asia/Tokyo", result.Timezone)
+	}
+}
+
+func TestRunAnalyzeRejectsBadTimezone(t *testing.T) {
+	dir := t.TempDir()
+	zipPath := filepath.Join(dir, "export.zip")
+	outPath := filepath.Join(dir, "result.json")
+
+	writeTestExport(t, zipPath, testTracks(10))
+
+	if err := runAnalyze([]string{"--zip", zipPath, "--out", outPath, "--timezone", "Mars/Olympus"}); err == nil {
+		t.Fatal("bad timezone was accepted")
+	}
+
+	if _, err := os.Stat(outPath); !os.IsNotExist(err) {
+		t.Fatalf("result was written for a bad timezone (%v)", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+func envString(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Warning: invalid %s %q, using %d", name, value, fallback)
+		return fallback
+	}
+
+	return parsed
+}
+
+func envInt64(name string, fallback int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Printf("Warning: invalid %s %q, using %d", name, value, fallback)
+		return fallback
+	}
+
+	return parsed
+}
+
+func envBool(name string, fallback bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Warning: invalid %s %q, using %t", name, value, fallback)
+		return fallback
+	}
+
+	return parsed
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Warning: invalid %s %q, using %s", name, value, fallback)
+		return fallback
+	}
+
+	return parsed
+}
+
+func jobLimitsFromEnv() JobLimits {
+	limits := DefaultJobLimits()
+	limits.MaxDuration = envDuration("JOB_MAX_DURATION", limits.MaxDuration)
+	limits.MaxArchiveBytes = envInt64("JOB_MAX_ARCHIVE_BYTES", limits.MaxArchiveBytes)
+	limits.MaxUncompressedBytes = envInt64("JOB_MAX_UNCOMPRESSED_BYTES", limits.MaxUncompressedBytes)
+	limits.MaxEntries = envInt("JOB_MAX_ENTRIES", limits.MaxEntries)
+	limits.MaxDiskBytes = envInt64("JOB_MAX_DISK_BYTES", limits.MaxDiskBytes)
+
+	return limits
+}
+
+func archiveLimitsFromEnv() ArchiveLimits {
+	limits := DefaultArchiveLimits()
+	limits.MaxEntries = envInt("ARCHIVE_MAX_ENTRIES", limits.MaxEntries)
+	limits.MaxEntryBytes = envInt64("ARCHIVE_MAX_ENTRY_BYTES", limits.MaxEntryBytes)
+	limits.MaxCompressionRatio = float64(envInt("ARCHIVE_MAX_COMPRESSION_RATIO", int(limits.MaxCompressionRatio)))
+
+	return limits
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetter is a job that failed and was parked so it can be looked at and
+// replayed later.
+type DeadLetter struct {
+	ID        string    `json:"id"`
+	Job       Job       `json:"job"`
+	Stage     JobStatus `json:"stage"`
+	ErrorCode ErrorCode `json:"error_code"`
+	Error     string    `json:"error"`
+	FailedAt  time.Time `json:"failed_at"`
+}
+
+// DeadLetterStore keeps one JSON file per dead letter, keyed by the job's
+// process id so a job that fails again replaces its previous record.
+type DeadLetterStore struct {
+	dir string
+}
+
+func NewDeadLetterStore(dir string) (*DeadLetterStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create dead letter directory: %w", err)
+	}
+
+	return &DeadLetterStore{dir: dir}, nil
+}
+
+func (s *DeadLetterStore) Add(job *Job, stage JobStatus, jobErr *JobError) (*DeadLetter, error) {
+	letter := &DeadLetter{
+		ID:        job.ProcessID,
+		Job:       *job,
+		Stage:     stage,
+		ErrorCode: jobErr.Code,
+		Error:     jobErr.Error(),
+		FailedAt:  time.Now(),
+	}
+
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling dead letter: %w", err)
+	}
+
+	if err := writeFileAtomic(s.dir, s.path(letter.ID), data); err != nil {
+		return nil, err
+	}
+
+	return letter, nil
+}
+
+func (s *DeadLetterStore) Get(id string) (*DeadLetter, error) {
+	data, err := os.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading dead letter: %w", err)
+	}
+
+	letter := new(DeadLetter)
+	if err := json.Unmarshal(data, letter); err != nil {
+		return nil, fmt.Errorf("error parsing dead letter: %w", err)
+	}
+
+	return letter, nil
+}
+
+// List returns every dead letter, most recent failure first.
+func (s *DeadLetterStore) List() ([]*DeadLetter, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead letter directory: %w", err)
+	}
+
+	letters := make([]*DeadLetter, 0, len(files))
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(s.dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("error reading dead letter: %w", err)
+		}
+
+		letter := new(DeadLetter)
+		if err := json.Unmarshal(data, letter); err != nil {
+			log.Printf("Skipping unreadable dead letter %s: %v", file.Name(), err)
+			continue
+		}
+
+		letters = append(letters, letter)
+	}
+
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].FailedAt.After(letters[j].FailedAt)
+	})
+
+	return letters, nil
+}
+
+func (s *DeadLetterStore) Remove(id string) error {
+	err := os.Remove(s.path(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *DeadLetterStore) path(id string) string {
+	return filepath.Join(s.dir, fileKey(id)+".json")
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyBlobStore fails every download until it is fixed.
+type flakyBlobStore struct {
+	*MemoryBlobStore
+
+	mu    sync.Mutex
+	fixed bool
+	gets  int
+}
+
+func (s *flakyBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.gets++
+	if !s.fixed {
+		return nil, 0, errors.New("connection reset")
+	}
+
+	return s.MemoryBlobStore.Get(ctx, key)
+}
+
+func (s *flakyBlobStore) fix() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fixed = true
+}
+
+func TestExhaustedJobIsParkedAndReplayed(t *testing.T) {
+	stub := newMainAppStub(t)
+	t.Setenv("ADMIN_AUTH_KEY", "admin")
+	dir := t.TempDir()
+
+	store, err := NewFileJobStore(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := &flakyBlobStore{MemoryBlobStore: NewMemoryBlobStore()}
+	blobs.blobs["exports/p1.zip"] = testExportBytes(t, testTracks(10))
+
+	q := newTestQueue(t, dir, blobs, store)
+	q.retry = RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	q.Start()
+	defer stopQueue(t, q, 5*time.Second)
+
+	if _, err := q.AddJob(&Job{S3Key: "exports/p1.zip", ProcessID: "p1", UserID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "failure callback", func() bool {
+		return len(stub.received()) > 0
+	})
+
+	blobs.mu.Lock()
+	gets := blobs.gets
+	blobs.mu.Unlock()
+
+	if gets != 3 {
+		t.Fatalf("download was tried %d times, want 3", gets)
+	}
+
+	letter, err := q.deadLetters.Get("p1")
+	if err != nil {
+		t.Fatalf("exhausted job was not parked: %v", err)
+	}
+	if letter.Job.S3Key != "exports/p1.zip" || letter.Job.UserID != "u1" || letter.Job.Attempts != 1 ||
+		letter.Stage != StatusDownloading || letter.Error == "" {
+		t.Fatalf("dead letter = %+v, want p1 of u1 failed while downloading", letter)
+	}
+
+	blobs.fix()
+
+	app := newTestServer(t, q, DefaultJobLimits())
+
+	req := httptest.NewRequest("POST", "/admin/dead-letters/p1/replay", nil)
+	req.Header.Set("x-admin-key", "admin")
+
+	resp, body := send(t, app, req)
+	if resp.StatusCode != 200 {
+		t.Fatalf("replay = %d %v, want 200", resp.StatusCode, body)
+	}
+
+	waitFor(t, "replayed job to complete", func() bool {
+		state, _ := q.Status("p1")
+		return state.Status == StatusCompleted
+	})
+
+	if state, _ := q.Status("p1"); state.Attempts != 1 {
+		t.Fatalf("replayed job ran as attempt %d, want its attempts reset", state.Attempts)
+	}
+
+	callbacks := stub.received()
+	if len(callbacks) != 2 || callbacks[0].Body.Success || !callbacks[1].Body.Success {
+		t.Fatalf("callbacks = %+v, want the failure and then the result", callbacks)
+	}
+
+	if _, err := q.deadLetters.Get("p1"); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Fatalf("dead letter after replay = %v, want it removed", err)
+	}
+}
+
+func TestDeadLettersCanBeFilteredByUser(t *testing.T) {
+	t.Setenv("ADMIN_AUTH_KEY", "admin")
+
+	app, q := newTestApp(t, DefaultJobLimits())
+
+	jobErr := NewJobError(ErrCodeDownloadFailed, errors.New("connection reset"))
+	for _, job := range []*Job{
+		{S3Key: "exports/p1.zip", ProcessID: "p1", UserID: "u1"},
+		{S3Key: "exports/p2.zip", ProcessID: "p2", UserID: "u2"},
+		{S3Key: "exports/p3.zip", ProcessID: "p3", UserID: "u1"},
+	} {
+		if _, err := q.deadLetters.Add(job, StatusDownloading, jobErr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[string][]string{
+		"/admin/dead-letters":            {"p1", "p2", "p3"},
+		"/admin/dead-letters?user_id=u1": {"p1", "p3"},
+		"/admin/dead-letters?user_id=u3": {},
+	}
+
+	for url, want := range tests {
+		req := httptest.NewRequest("GET", url, nil)
+		req.Header.Set("x-admin-key", "admin")
+
+		resp, body := send(t, app, req)
+		if resp.StatusCode != 200 {
+			t.Fatalf("%s = %d, want 200", url, resp.StatusCode)
+		}
+
+		letters, _ := body["dead_letters"].([]any)
+
+		got := map[string]bool{}
+		for _, letter := range letters {
+			got[letter.(map[string]any)["id"].(string)] = true
+		}
+
+		if len(got) != len(want) {
+			t.Errorf("%s = %v, want %v", url, got, want)
+			continue
+		}
+		for _, id := range want {
+			if !got[id] {
+				t.Errorf("%s = %v, want %v", url, got, want)
+			}
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/admin/dead-letters", nil)
+	req.Header.Set("x-admin-key", "wrong")
+
+	if resp, _ := send(t, app, req); resp.StatusCode != 401 {
+		t.Fatalf("wrong admin key = %d, want 401", resp.StatusCode)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+type ErrorCode string
+
+const (
+	ErrCodeDownloadFailed ErrorCode = "download_failed"
+	ErrCodeInvalidArchive ErrorCode = "invalid_archive"
+	ErrCodeUnsafeArchive  ErrorCode = "unsafe_archive"
+	ErrCodeNoHistoryFiles ErrorCode = "no_history_files"
+	ErrCodeParseFailed    ErrorCode = "parse_failed"
+	ErrCodeUploadFailed   ErrorCode = "upload_failed"
+	ErrCodeCallbackFailed ErrorCode = "callback_failed"
+	ErrCodeCancelled      ErrorCode = "cancelled"
+	ErrCodeInternal       ErrorCode = "internal_error"
+
+	ErrCodeLimitDuration     ErrorCode = "limit_wall_time"
+	ErrCodeLimitArchiveSize  ErrorCode = "limit_archive_size"
+	ErrCodeLimitUncompressed ErrorCode = "limit_uncompressed_size"
+	ErrCodeLimitEntries      ErrorCode = "limit_entries"
+	ErrCodeLimitDisk         ErrorCode = "limit_disk_usage"
+)
+
+// Messages sent to the main app alongside the error code. These end up in
+// front of users, so they must never include internal details.
+var userMessages = map[ErrorCode]string{
+	ErrCodeDownloadFailed: "We couldn't retrieve your upload. Please try uploading it again.",
+	ErrCodeInvalidArchive: "Your file doesn't look like a valid zip archive. Please upload the zip you received from Spotify.",
+	ErrCodeUnsafeArchive:  "Your zip file contains something we can't safely process. Please upload the original zip you received from Spotify.",
+	ErrCodeNoHistoryFiles: "We couldn't find any streaming history in your zip. Make sure you uploaded your Spotify data export.",
+	ErrCodeParseFailed:    "We couldn't read the listening history in your export.",
+	ErrCodeUploadFailed:   "Something went wrong while saving your results. Please try again later.",
+	ErrCodeCallbackFailed: "Something went wrong while saving your results. Please try again later.",
+	ErrCodeCancelled:      "Processing was cancelled.",
+	ErrCodeInternal:       "Something went wrong while processing your data. Please try again later.",
+
+	ErrCodeLimitDuration:     "Your export took too long to process.",
+	ErrCodeLimitArchiveSize:  "Your zip file is too large to process.",
+	ErrCodeLimitUncompressed: "Your zip file contains too much data to process.",
+	ErrCodeLimitEntries:      "Your export contains more listening history than we can process.",
+	ErrCodeLimitDisk:         "Your zip file contains too much data to process.",
+}
+
+// JobError is a job failure with a machine readable code and a message that
+// is safe to show to users. Err holds the underlying cause for the logs.
+type JobError struct {
+	Code    ErrorCode
+	Message string
+	Err     error
+}
+
+func NewJobError(code ErrorCode, err error) *JobError {
+	return &JobError{
+		Code:    code,
+		Message: userMessages[code],
+		Err:     err,
+	}
+}
+
+func (e *JobError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Code, e.Err)
+}
+
+func (e *JobError) Unwrap() error {
+	return e.Err
+}
+
+// asJobError returns err as a *JobError, treating anything unclassified as an
+// internal error.
+func asJobError(err error) *JobError {
+	var jobErr *JobError
+	if errors.As(err, &jobErr) {
+		return jobErr
+	}
+
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		return NewJobError(limitErr.Code, err)
+	}
+
+	return NewJobError(ErrCodeInternal, err)
+}
@@ -2,110 +2,210 @@ package main
 
 import (
 	"archive/zip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"os"
-	"path/filepath"
-	"strings"
+	"path"
 )
 
 const SPOTIFY_FOLDER_NAME = "Spotify Extended Streaming History"
 
-func ExtractAndFindAudioHistoryFiles(zipPath, destDir string) ([]string, error) {
+var (
+	ErrInvalidArchive = errors.New("invalid archive")
+	ErrNoHistoryFiles = errors.New("no JSON file found in the archive")
+)
+
+// HistoryFile is a streaming history file inside the uploaded archive. It is
+// read straight out of the zip and never written to disk.
+type HistoryFile struct {
+	Name   string
+	Format HistoryFormat
+
+	file    *zip.File
+	archive *HistoryArchive
+
+	// read is the most that has been read of the file so far. Reading it
+	// again doesn't make the archive any bigger, so only bytes past that
+	// are charged.
+	read int64
+}
+
+// HistoryArchive is an opened export along with the history files found in
+// it. Close it once the files have been read.
+type HistoryArchive struct {
+	Files []*HistoryFile
+
+	ctx     context.Context
+	reader  *zip.ReadCloser
+	limiter *entryLimiter
+	budget  *JobBudget
+}
+
+func (a *HistoryArchive) Close() error {
+	return a.reader.Close()
+}
+
+// Open returns a reader for the file's decompressed contents. Everything
+// read through it counts against the archive limits and the job budget,
+// once: opening the file again only charges what goes past the first read.
+func (f *HistoryFile) Open() (io.ReadCloser, error) {
+	rc, err := f.file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to open %s: %v", ErrInvalidArchive, f.Name, err)
+	}
+
+	var read int64
+	a := f.archive
+
+	return &entryReader{
+		name: f.Name,
+		rc:   rc,
+		r:    &contextReader{ctx: a.ctx, r: rc},
+		charge: func(n int64) error {
+			read += n
+
+			fresh := read - f.read
+			if fresh <= 0 {
+				return nil
+			}
+
+			if err := a.limiter.charge(f.file, &f.read, fresh); err != nil {
+				return err
+			}
+			return a.budget.AddUncompressed(fresh)
+		},
+	}, nil
+}
+
+// ExtractAndFindAudioHistoryFiles opens the archive and finds the streaming
+// history files in it, without extracting anything. The archive is checked
+// against limits first and rejected with an *ArchiveError if it breaks any
+// of them, or with a *LimitError if it holds more than budget allows.
+func ExtractAndFindAudioHistoryFiles(ctx context.Context, zipPath string, limits ArchiveLimits, budget *JobBudget) (*HistoryArchive, error) {
 
 	reader, err := zip.OpenReader(zipPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open zip file: %w", err)
+		return nil, fmt.Errorf("%w: failed to open zip file: %v", ErrInvalidArchive, err)
 	}
-	defer reader.Close()
 
-	for _, file := range reader.File {
-		path := filepath.Join(destDir, file.Name)
+	if err := CheckArchive(reader.File, limits); err != nil {
+		reader.Close()
+		return nil, err
+	}
 
-		if !strings.HasPrefix(path, filepath.Clean(destDir)+string(os.PathSeparator)) {
-			return nil, fmt.Errorf("illegal file path: %s", file.Name)
-		}
+	if err := budget.CheckUncompressed(claimedSize(reader.File)); err != nil {
+		reader.Close()
+		return nil, err
+	}
 
-		if file.FileInfo().IsDir() {
-			os.MkdirAll(path, file.Mode())
-			continue
-		}
+	archive := &HistoryArchive{
+		ctx:     ctx,
+		reader:  reader,
+		limiter: &entryLimiter{limits: limits},
+		budget:  budget,
+	}
 
-		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-			return nil, err
-		}
+	var extendedFiles []*zip.File
+	var basicFiles []*zip.File
+	var jsonFiles []*zip.File
 
-		destFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode())
-		if err != nil {
-			return nil, err
+	for _, file := range reader.File {
+		if file.FileInfo().IsDir() || path.Ext(file.Name) != ".json" {
+			continue
 		}
 
-		srcFile, err := file.Open()
-		if err != nil {
-			destFile.Close()
-			return nil, err
-		}
+		jsonFiles = append(jsonFiles, file)
 
-		_, err = io.Copy(destFile, srcFile)
-		srcFile.Close()
-		destFile.Close()
-		if err != nil {
-			return nil, err
+		switch detectFileFormat(file.Name) {
+		case FormatExtended:
+			log.Printf("Found JSON file: %s", file.Name)
+			extendedFiles = append(extendedFiles, file)
+		case FormatBasic:
+			log.Printf("Found basic history JSON file: %s", file.Name)
+			basicFiles = append(basicFiles, file)
 		}
 	}
 
-	spotifyFolder := filepath.Join(destDir, SPOTIFY_FOLDER_NAME)
+	// The extended history has everything the basic one does, so if both
+	// exports were zipped up together only the extended one is read.
+	if len(extendedFiles) > 0 {
+		archive.Files = archive.wrap(extendedFiles)
+		return archive, nil
+	}
 
-	if _, err := os.Stat(spotifyFolder); !os.IsNotExist(err) {
-		log.Printf("Found Spotify folder: %s", spotifyFolder)
+	if len(basicFiles) > 0 {
+		archive.Files = archive.wrap(basicFiles)
+		return archive, nil
+	}
 
-		var folderJsonFiles []string
+	if len(jsonFiles) > 0 {
+		log.Printf("Found JSON file through fallback search: %d", len(jsonFiles))
+		archive.Files = archive.wrap(jsonFiles)
+		return archive, nil
+	}
 
-		files, err := os.ReadDir(spotifyFolder)
-		if err == nil {
-			for _, file := range files {
-				if file.IsDir() {
-					continue
-				}
+	reader.Close()
 
-				fileNameLowercased := strings.ToLower(file.Name())
+	return nil, ErrNoHistoryFiles
+}
 
-				if filepath.Ext(file.Name()) == ".json" && strings.Contains(fileNameLowercased, "history") && strings.Contains(fileNameLowercased, "audio") {
-					jsonPath := filepath.Join(spotifyFolder, file.Name())
-					log.Printf("Found JSON file: %s", jsonPath)
-					folderJsonFiles = append(folderJsonFiles, jsonPath)
-				}
-			}
-		}
+func (a *HistoryArchive) wrap(files []*zip.File) []*HistoryFile {
+	wrapped := make([]*HistoryFile, 0, len(files))
 
-		if len(folderJsonFiles) > 0 {
-			return folderJsonFiles, nil
-		}
+	for _, file := range files {
+		wrapped = append(wrapped, &HistoryFile{
+			Name:    file.Name,
+			Format:  detectFileFormat(file.Name),
+			file:    file,
+			archive: a,
+		})
 	}
 
-	var jsonFiles []string
+	return wrapped
+}
 
-	err = filepath.Walk(destDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+// entryReader charges every decompressed byte before handing it out.
+type entryReader struct {
+	name   string
+	rc     io.Closer
+	r      io.Reader
+	charge func(int64) error
+}
 
-		if !info.IsDir() && filepath.Ext(path) == ".json" {
-			jsonFiles = append(jsonFiles, path)
+func (er *entryReader) Read(p []byte) (int, error) {
+	n, err := er.r.Read(p)
+	if n > 0 {
+		if chargeErr := er.charge(int64(n)); chargeErr != nil {
+			return 0, chargeErr
 		}
+	}
 
-		return nil
-	})
-
-	if err != nil {
-		return nil, fmt.Errorf("error searching for JSON file: %w", err)
+	// archive/zip returns ErrFormat once an entry decompresses to more than
+	// its directory said it would.
+	if errors.Is(err, zip.ErrFormat) {
+		return n, &ArchiveError{Rule: RuleSizeMismatch, Entry: er.name, Detail: "entry is larger than its stated size"}
 	}
 
-	if len(jsonFiles) > 0 {
-		log.Printf("Found JSON file through fallback search: %d", len(jsonFiles))
-		return jsonFiles, nil
+	return n, err
+}
+
+func (er *entryReader) Close() error {
+	return er.rc.Close()
+}
+
+// contextReader stops a read as soon as its context is cancelled, so large
+// entries don't have to be read to the end first.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
 	}
 
-	return nil, fmt.Errorf("no JSON file found in the archive")
+	return cr.r.Read(p)
 }
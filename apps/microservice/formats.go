@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// HistoryFormat is the schema a streaming history file was exported in.
+type HistoryFormat string
+
+const (
+	FormatUnknown HistoryFormat = ""
+
+	// FormatExtended is the "Extended streaming history" export, with
+	// Streaming_History_Audio_*.json and Streaming_History_Video_*.json files
+	// per period.
+	FormatExtended HistoryFormat = "extended"
+
+	// FormatBasic is the quicker "Account data" export. Its
+	// StreamingHistory_music_*.json and StreamingHistory_podcast_*.json files
+	// only have the end time, artist or show, track or episode and ms played,
+	// so there are no URIs, albums, platforms or countries to report on.
+	FormatBasic HistoryFormat = "basic"
+)
+
+const basicTimestampLayout = "2006-01-02 15:04"
+
+var basicHistoryFileName = regexp.MustCompile(`^streaminghistory(_music_|_podcast_)?\d+\.json$`)
+
+// basicTrack is an entry in the basic "Account data" export.
+type basicTrack struct {
+	EndTime     string `json:"endTime"`
+	ArtistName  string `json:"artistName"`
+	TrackName   string `json:"trackName"`
+	PodcastName string `json:"podcastName"`
+	EpisodeName string `json:"episodeName"`
+	MsPlayed    int    `json:"msPlayed"`
+}
+
+// toTrack normalizes the entry into the extended schema. Fields the basic
+// export doesn't have are left empty.
+func (b basicTrack) toTrack() Track {
+	ts := b.EndTime
+
+	if endTime, err := time.Parse(basicTimestampLayout, b.EndTime); err == nil {
+		ts = endTime.Format(timestampLayout)
+	}
+
+	return Track{
+		Ts:                            ts,
+		MsPlayed:                      b.MsPlayed,
+		MasterMetadataTrackName:       b.TrackName,
+		MasterMetadataAlbumArtistName: b.ArtistName,
+		EpisodeShowName:               b.PodcastName,
+		EpisodeName:                   b.EpisodeName,
+	}
+}
+
+// detectFileFormat works out a history file's format from its name, which is
+// all we need for files Spotify named. Anything else is FormatUnknown and
+// detected from its first entry instead.
+func detectFileFormat(name string) HistoryFormat {
+	base := strings.ToLower(path.Base(name))
+
+	if path.Base(path.Dir(name)) == SPOTIFY_FOLDER_NAME && strings.Contains(base, "history") && (strings.Contains(base, "audio") || strings.Contains(base, "video")) {
+		return FormatExtended
+	}
+
+	if basicHistoryFileName.MatchString(base) {
+		return FormatBasic
+	}
+
+	return FormatUnknown
+}
+
+// detectEntryFormat looks at which timestamp field an entry has.
+func detectEntryFormat(raw json.RawMessage) HistoryFormat {
+	var probe struct {
+		Ts      *string `json:"ts"`
+		EndTime *string `json:"endTime"`
+	}
+
+	if err := json.Unmarshal(raw, &probe); err == nil && probe.Ts == nil && probe.EndTime != nil {
+		return FormatBasic
+	}
+
+	return FormatExtended
+}
+
+// readEntry decodes the next entry of a file in the given format. If the
+// format isn't known yet, it is detected from the entry and stored for the
+// rest of the file.
+func readEntry(decoder *json.Decoder, format *HistoryFormat) (Track, error) {
+	if *format == FormatUnknown {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return Track{}, err
+		}
+
+		*format = detectEntryFormat(raw)
+
+		return unmarshalEntry(raw, *format)
+	}
+
+	if *format == FormatBasic {
+		var entry basicTrack
+		if err := decoder.Decode(&entry); err != nil {
+			return Track{}, err
+		}
+
+		return entry.toTrack(), nil
+	}
+
+	var track Track
+	err := decoder.Decode(&track)
+
+	return track, err
+}
+
+func unmarshalEntry(raw json.RawMessage, format HistoryFormat) (Track, error) {
+	if format == FormatBasic {
+		var entry basicTrack
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return Track{}, err
+		}
+
+		return entry.toTrack(), nil
+	}
+
+	var track Track
+	err := json.Unmarshal(raw, &track)
+
+	return track, err
+}
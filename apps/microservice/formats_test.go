@@ -0,0 +1,174 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDetectFileFormat(t *testing.T) {
+	tests := map[string]HistoryFormat{
+		SPOTIFY_FOLDER_NAME + "/Streaming_History_Audio_2023.json":      FormatExtended,
+		SPOTIFY_FOLDER_NAME + "/Streaming_History_Video_2020-2023.json": FormatExtended,
+		"MyData/StreamingHistory0.json":                                 FormatBasic,
+		"MyData/StreamingHistory_music_0.json":                          FormatBasic,
+		"Spotify Account Data/StreamingHistory_podcast_12.json":         FormatBasic,
+		"Streaming_History_Audio_2023.json":                             FormatUnknown,
+		"MyData/Playlist1.json":                                         FormatUnknown,
+		"history.json":                                                  FormatUnknown,
+	}
+
+	for name, want := range tests {
+		if got := detectFileFormat(name); got != want {
+			t.Errorf("detectFileFormat(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestDetectEntryFormat(t *testing.T) {
+	tests := map[string]HistoryFormat{
+		`{"ts": "2023-01-06T23:30:00Z", "ms_played": 1000}`: FormatExtended,
+		`{"endTime": "2023-01-06 23:30", "msPlayed": 1000}`: FormatBasic,
+		`{"ts": "2023-01-06T23:30:00Z", "endTime": "x"}`:    FormatExtended,
+		`{"msPlayed": 1000}`: FormatExtended,
+	}
+
+	for entry, want := range tests {
+		if got := detectEntryFormat(json.RawMessage(entry)); got != want {
+			t.Errorf("detectEntryFormat(%s) = %q, want %q", entry, got, want)
+		}
+	}
+}
+
+func TestBasicTrackToTrack(t *testing.T) {
+	tests := []struct {
+		entry basicTrack
+		want  Track
+	}{
+		{
+			basicTrack{EndTime: "2023-01-06 23:30", ArtistName: "Artist A", TrackName: "Song", MsPlayed: 180_000},
+			Track{Ts: "2023-01-06T23:30:00Z", MsPlayed: 180_000, MasterMetadataAlbumArtistName: "Artist A", MasterMetadataTrackName: "Song"},
+		},
+		{
+			basicTrack{EndTime: "2023-01-06 23:30", PodcastName: "Show", EpisodeName: "Episode 1", MsPlayed: 60_000},
+			Track{Ts: "2023-01-06T23:30:00Z", MsPlayed: 60_000, EpisodeShowName: "Show", EpisodeName: "Episode 1"},
+		},
+		{
+			// An end time that doesn't parse is kept, and rejected later like
+			// any other bad timestamp.
+			basicTrack{EndTime: "yesterday", TrackName: "Song"},
+			Track{Ts: "yesterday", MasterMetadataTrackName: "Song"},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := tt.entry.toTrack(); got != tt.want {
+			t.Errorf("toTrack(%+v) = %+v, want %+v", tt.entry, got, tt.want)
+		}
+	}
+}
+
+// basicEntries encodes n basic entries ending 4 minutes apart.
+func basicEntries(t *testing.T, n int, entry basicTrack) []byte {
+	t.Helper()
+
+	at := time.Date(2023, 1, 6, 12, 0, 0, 0, time.UTC)
+
+	entries := make([]basicTrack, n)
+	for i := range entries {
+		entries[i] = entry
+		entries[i].EndTime = at.Add(time.Duration(i) * 4 * time.Minute).Format(basicTimestampLayout)
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestBasicExportWithPodcasts(t *testing.T) {
+	path := buildZip(t, func(t *testing.T, w *zip.Writer) {
+		addEntry(t, w, "MyData/StreamingHistory_music_0.json",
+			basicEntries(t, 12, basicTrack{ArtistName: "Artist A", TrackName: "Song", MsPlayed: 180_000}))
+		addEntry(t, w, "MyData/StreamingHistory_podcast_0.json",
+			basicEntries(t, 3, basicTrack{PodcastName: "Show", EpisodeName: "Episode 1", MsPlayed: 600_000}))
+		addEntry(t, w, "MyData/Playlist1.json", []byte(`{"playlists": []}`))
+	})
+
+	result := analyzeExport(t, path, AnalysisOptions{})
+
+	if result.Format != FormatBasic {
+		t.Errorf("format = %q, want %q", result.Format, FormatBasic)
+	}
+	if result.RawTotalTracks != 12 || len(result.TopTracks) != 1 || result.TopTracks[0].Count != 12 {
+		t.Errorf("music = %d plays, top tracks %+v, want 12 plays of one song", result.RawTotalTracks, result.TopTracks)
+	}
+
+	podcasts := result.Podcasts
+	if podcasts.MusicMs != 12*180_000 || podcasts.PodcastMs != 3*600_000 {
+		t.Errorf("music %d ms, podcasts %d ms, want %d and %d", podcasts.MusicMs, podcasts.PodcastMs, 12*180_000, 3*600_000)
+	}
+	if len(podcasts.TopShows) != 1 || podcasts.TopShows[0].Show != "Show" || podcasts.TopShows[0].Count != 3 {
+		t.Errorf("top shows = %+v, want 3 plays of Show", podcasts.TopShows)
+	}
+}
+
+func TestUnknownFilesAreProbed(t *testing.T) {
+	extended, err := json.Marshal(testTracks(12))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want HistoryFormat
+	}{
+		{"basic", basicEntries(t, 12, basicTrack{ArtistName: "Artist A", TrackName: "Song", MsPlayed: 180_000}), FormatBasic},
+		{"extended", extended, FormatExtended},
+	}
+
+	for _, tt := range tests {
+		// Renamed, so only the entries tell what it is.
+		path := buildZip(t, func(t *testing.T, w *zip.Writer) {
+			addEntry(t, w, "export/history.json", tt.data)
+		})
+
+		result := analyzeExport(t, path, AnalysisOptions{})
+
+		if result.Format != tt.want || result.RawTotalTracks != 12 {
+			t.Errorf("%s: format %q with %d plays, want %q with 12", tt.name, result.Format, result.RawTotalTracks, tt.want)
+		}
+	}
+}
+
+func TestFileMalformedPartwayKeepsEarlierEntries(t *testing.T) {
+	tracks := testTracks(5)
+
+	good, err := json.Marshal(tracks[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Three entries, then the file is cut off in the middle of the fourth.
+	cut, err := json.Marshal(tracks[2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := append(bytes.TrimSuffix(cut, []byte("]")), `,{"ts": "2023-`...)
+
+	path := buildZip(t, func(t *testing.T, w *zip.Writer) {
+		addEntry(t, w, SPOTIFY_FOLDER_NAME+"/Streaming_History_Audio_2022.json", good)
+		addEntry(t, w, SPOTIFY_FOLDER_NAME+"/Streaming_History_Audio_2023.json", broken)
+	})
+
+	result := analyzeExport(t, path, AnalysisOptions{})
+
+	if result.RawTotalTracks != 5 {
+		t.Fatalf("parsed %d plays, want the 2 of the good file and the 3 before the cut", result.RawTotalTracks)
+	}
+}
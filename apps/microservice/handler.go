@@ -1,62 +1,85 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"time"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
+// RequestBody is the callback sent to the main app. UploadSize and SHA256
+// describe the gzipped result as stored, UncompressedSize the JSON inside it.
 type RequestBody struct {
-	Success    bool   `json:"success"`
-	UploadSize int    `json:"upload_size"`
-	S3Key      string `json:"s3_key"`
+	Success          bool      `json:"success"`
+	UploadSize       int64     `json:"upload_size"`
+	UncompressedSize int64     `json:"uncompressed_size,omitempty"`
+	SHA256           string    `json:"sha256,omitempty"`
+	S3Key            string    `json:"s3_key"`
+	ErrorCode        ErrorCode `json:"error_code,omitempty"`
+	ErrorMessage     string    `json:"error_message,omitempty"`
 }
 
-func SendToBackend(s3Client *s3.Client, bucketName string, payload *ProcessResult) error {
-
-	appUrl := os.Getenv("MAIN_APP_URL")
+// UploadResult stores the gzipped result for the main app to pick up,
+// returning the callback body that points at it. The result is encoded,
+// compressed and uploaded as it goes, so neither the JSON nor the gzip is
+// ever held in memory as a whole.
+func UploadResult(ctx context.Context, store BlobStore, payload *ProcessResult) (*RequestBody, error) {
+	s3Key := fmt.Sprintf("data-transfers/%s.json.gz", payload.ProcessID)
 
-	url := fmt.Sprintf("%s/api/processors/%s/results", appUrl, payload.ProcessID)
+	reader, writer := io.Pipe()
 
-	fmt.Println("APP URL:", url)
+	var stats compressStats
+	done := make(chan error, 1)
 
-	compressedData, err := compressJson(payload)
-	if err != nil {
-		fmt.Printf("Failed to compress json. Error %v", err)
-	}
-
-	s3Key := fmt.Sprintf("data-transfers/%s.json.gz", payload.ProcessID)
+	go func() {
+		err := compressJson(writer, payload, &stats)
+		writer.CloseWithError(err)
+		done <- err
+	}()
 
-	uploadInput := &s3.PutObjectInput{
-		Bucket:      aws.String(bucketName),
-		Key:         aws.String(s3Key),
-		Body:        bytes.NewReader(compressedData),
-		ContentType: aws.String("application/gzip"),
+	err := store.Put(ctx, s3Key, reader, PutOptions{
+		ContentType: "application/gzip",
 		Metadata: map[string]string{
 			"created-at":   time.Now().Format(time.RFC3339),
 			"content-type": "spotify-data",
 		},
+	})
+
+	// Unblocks the encoder if the store gave up before reading everything.
+	reader.CloseWithError(err)
+
+	if compressErr := <-done; compressErr != nil && err == nil {
+		err = fmt.Errorf("failed to compress json: %w", compressErr)
 	}
 
-	_, err = s3Client.PutObject(context.TODO(), uploadInput)
 	if err != nil {
-		return fmt.Errorf("error uploading to S3: %w", err)
+		return nil, fmt.Errorf("error uploading result: %w", err)
 	}
 
-	requestBody := RequestBody{
-		Success:    true,
-		UploadSize: len(compressedData),
-		S3Key:      s3Key,
-	}
+	return &RequestBody{
+		Success:          true,
+		UploadSize:       stats.compressed,
+		UncompressedSize: stats.uncompressed,
+		SHA256:           hex.EncodeToString(stats.sha256),
+		S3Key:            s3Key,
+	}, nil
+}
+
+// SendToBackend posts the result callback for a job to the main app.
+func SendToBackend(ctx context.Context, processID string, requestBody *RequestBody) error {
+	appUrl := os.Getenv("MAIN_APP_URL")
+
+	url := fmt.Sprintf("%s/api/processors/%s/results", appUrl, processID)
+
+	fmt.Println("APP URL:", url)
 
 	jsonData, err := json.Marshal(requestBody)
 	if err != nil {
@@ -67,9 +90,9 @@ func SendToBackend(s3Client *s3.Client, bucketName string, payload *ProcessResul
 		Timeout: 20 * time.Second,
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
-		fmt.Printf("Error creating request: %v", err)
+		return fmt.Errorf("error creating request: %w", err)
 	}
 
 	authKey := os.Getenv("APP_AUTH_KEY")
@@ -79,49 +102,80 @@ func SendToBackend(s3Client *s3.Client, bucketName string, payload *ProcessResul
 
 	resp, err := client.Do(req)
 	if err != nil {
-		fmt.Println("Error sending HTTP request:", err)
-		return err
+		return fmt.Errorf("error sending HTTP request: %w", err)
 	}
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		body, err := io.ReadAll(resp.Body)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response: %w", err)
+	}
 
-		if err != nil {
-			fmt.Println("Error reading response:", err)
-			return err
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &HTTPStatusError{
+			StatusCode: resp.StatusCode,
+			Body:       string(body),
 		}
-
-		fmt.Printf("Request successful! Status: %d, Response length: %d bytes\n", resp.StatusCode, len(body))
-	} else {
-		body, _ := io.ReadAll(resp.Body)
-		fmt.Printf("Request failed with status %d: %s\n", resp.StatusCode, string(body))
 	}
 
+	fmt.Printf("Request successful! Status: %d, Response length: %d bytes\n", resp.StatusCode, len(body))
+
 	return nil
 }
 
-func compressJson(data interface{}) ([]byte, error) {
-	jsonData, err := json.Marshal(data)
+// SendFailureToBackend tells the main app that a job failed, with an error
+// code it can act on and a message it can show to the user.
+func SendFailureToBackend(ctx context.Context, processID string, jobErr *JobError) error {
+	return SendToBackend(ctx, processID, &RequestBody{
+		Success:      false,
+		ErrorCode:    jobErr.Code,
+		ErrorMessage: jobErr.Message,
+	})
+}
 
-	if err != nil {
-		return nil, fmt.Errorf("error marshaling JSON: %w", err)
+type compressStats struct {
+	uncompressed int64
+	compressed   int64
+	sha256       []byte
+}
 
-	}
+// compressJson writes data to w as gzipped JSON, recording the sizes on both
+// sides of the gzip and the checksum of what was written to w.
+func compressJson(w io.Writer, data interface{}, stats *compressStats) error {
+	hash := sha256.New()
+	compressed := &countingWriter{w: io.MultiWriter(w, hash)}
 
-	var compressedBuffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(compressed)
+	uncompressed := &countingWriter{w: gzipWriter}
+	buffered := bufio.NewWriterSize(uncompressed, 64<<10)
 
-	gzipWriter := gzip.NewWriter(&compressedBuffer)
+	if err := writeJSONStream(buffered, data); err != nil {
+		return fmt.Errorf("error writing JSON: %w", err)
+	}
 
-	_, err = gzipWriter.Write(jsonData)
-	if err != nil {
-		return nil, fmt.Errorf("error writing to gzip writer: %w", err)
+	if err := buffered.Flush(); err != nil {
+		return fmt.Errorf("error writing to gzip writer: %w", err)
 	}
 
 	if err := gzipWriter.Close(); err != nil {
-		return nil, fmt.Errorf("error closing gzip writer: %w", err)
+		return fmt.Errorf("error closing gzip writer: %w", err)
 	}
 
-	return compressedBuffer.Bytes(), nil
+	stats.uncompressed = uncompressed.n
+	stats.compressed = compressed.n
+	stats.sha256 = hash.Sum(nil)
+
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
 }
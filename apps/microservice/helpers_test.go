@@ -0,0 +1,176 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTracks returns n extended history entries spread over a few artists,
+// tracks and days.
+func testTracks(n int) []Track {
+	tracks := make([]Track, n)
+	for i := range tracks {
+		tracks[i] = testTrack(i)
+	}
+
+	return tracks
+}
+
+// testTrack returns the i-th entry of a synthetic extended history, three
+// minutes after the previous one.
+func testTrack(i int) Track {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	track := i % 50
+
+	return Track{
+		Ts:                            start.Add(time.Duration(i) * 3 * time.Minute).Format(timestampLayout),
+		Platform:                      "ios",
+		MsPlayed:                      30_000 + i%5*10_000,
+		ConnCountry:                   "DE",
+		MasterMetadataTrackName:       fmt.Sprintf("Track %d", track),
+		MasterMetadataAlbumArtistName: fmt.Sprintf("Artist %d", track%7),
+		MasterMetadataAlbumAlbumName:  fmt.Sprintf("Album %d", track%11),
+		SpotifyTrackUri:               fmt.Sprintf("spotify:track:%d", track),
+		ReasonEnd:                     "trackdone",
+	}
+}
+
+// writeTestExport writes a zip laid out like an extended streaming history
+// export holding tracks.
+func writeTestExport(tb testing.TB, path string, tracks []Track) {
+	tb.Helper()
+
+	file, err := os.Create(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer file.Close()
+
+	archive := zip.NewWriter(file)
+
+	entry, err := archive.Create(SPOTIFY_FOLDER_NAME + "/Streaming_History_Audio_2023.json")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if err := json.NewEncoder(entry).Encode(tracks); err != nil {
+		tb.Fatal(err)
+	}
+
+	if err := archive.Close(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// testExportBytes returns a test export as it would be stored in a blob.
+func testExportBytes(tb testing.TB, tracks []Track) []byte {
+	tb.Helper()
+
+	path := filepath.Join(tb.TempDir(), "export.zip")
+	writeTestExport(tb, path, tracks)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return data
+}
+
+type callback struct {
+	ProcessID string
+	Body      RequestBody
+}
+
+// mainAppStub stands in for the main app's result callback endpoint.
+type mainAppStub struct {
+	mu        sync.Mutex
+	callbacks []callback
+}
+
+func newMainAppStub(t *testing.T) *mainAppStub {
+	t.Helper()
+
+	stub := new(mainAppStub)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		processID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/processors/"), "/results")
+
+		var body RequestBody
+		data, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &body); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+
+		stub.mu.Lock()
+		stub.callbacks = append(stub.callbacks, callback{ProcessID: processID, Body: body})
+		stub.mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+
+	t.Setenv("MAIN_APP_URL", server.URL)
+	t.Setenv("APP_AUTH_KEY", "test")
+
+	return stub
+}
+
+func (s *mainAppStub) received() []callback {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]callback(nil), s.callbacks...)
+}
+
+// waitFor polls until cond holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// analyzeTracks runs tracks through the same parse and analysis a job does.
+func analyzeTracks(t *testing.T, tracks []Track, options AnalysisOptions) *ProcessResult {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "export.zip")
+	writeTestExport(t, path, tracks)
+
+	return analyzeExport(t, path, options)
+}
+
+// analyzeExport runs the export at path through the same parse and analysis
+// a job does.
+func analyzeExport(t *testing.T, path string, options AnalysisOptions) *ProcessResult {
+	t.Helper()
+
+	archive, err := ExtractAndFindAudioHistoryFiles(context.Background(), path, DefaultArchiveLimits(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	result, err := ProcessListeningHistoryFiles(context.Background(), archive.Files, "test", options, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Remasters show up as separate tracks with their own URIs and a suffix on
+// the title, e.g. "Song - Remastered 2011", "Song - 2009 Remaster" or
+// "Song (Remastered)". Live versions, remixes and edits are left alone since
+// they're different recordings.
+var remasterSuffix = regexp.MustCompile(`(?i)\s*(?:-\s*|[(\[])\s*(?:\d{4}\s+)?(?:digital(?:ly)?\s+)?remaster(?:ed)?(?:\s+version)?(?:\s+\d{4})?\s*[)\]]?\s*$`)
+
+// normalizeName reduces a name to what identifies it, ignoring case and
+// spacing.
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// normalizeTitle reduces a track or album title to what identifies it, so
+// that remasters and relinked copies of it compare equal.
+func normalizeTitle(title string) string {
+	return normalizeName(remasterSuffix.ReplaceAllString(title, ""))
+}
+
+// trackKey identifies a song across the history. Distinct URIs are kept
+// apart unless they are the same song on the same release, which is what a
+// relink or a remaster looks like: same artist, same title and same album
+// once remaster suffixes are dropped. Titles alone collide ("Intro" on two
+// albums), and URIs alone split a song that Spotify relinked or remastered.
+// The URI is used on its own when there is no title to go on.
+func trackKey(track Track) string {
+	title := normalizeTitle(track.MasterMetadataTrackName)
+	if title == "" {
+		return track.SpotifyTrackUri
+	}
+
+	return normalizeName(track.MasterMetadataAlbumArtistName) + "\x00" + title + "\x00" + normalizeTitle(track.MasterMetadataAlbumAlbumName)
+}
+
+// displayTitle picks which of a song's or album's titles to show, preferring
+// the shortest since that's usually the one without a remaster suffix.
+func displayTitle(current, candidate string) string {
+	if current == "" || (candidate != "" && len(candidate) < len(current)) || (len(candidate) == len(current) && candidate < current) {
+		return candidate
+	}
+
+	return current
+}
+
+// albumKey identifies an album by its artist as well as its name, since
+// every artist has a "Greatest Hits". Both are normalized like trackKey
+// does, so a remastered edition counts as the same album.
+func albumKey(track Track) string {
+	if track.MasterMetadataAlbumAlbumName == "" {
+		return ""
+	}
+
+	return normalizeName(track.MasterMetadataAlbumArtistName) + "\x00" + normalizeTitle(track.MasterMetadataAlbumAlbumName)
+}
+
+// uriCounts tracks how often each URI was played under a key, so that a song
+// with several URIs is reported with the one played most.
+type uriCounts map[string]map[string]int
+
+func (u uriCounts) add(key, uri string, count int) {
+	if uri == "" {
+		return
+	}
+
+	counts, ok := u[key]
+	if !ok {
+		counts = make(map[string]int, 1)
+		u[key] = counts
+	}
+
+	counts[uri] += count
+}
+
+func (u uriCounts) merge(other uriCounts) {
+	for key, counts := range other {
+		for uri, count := range counts {
+			u.add(key, uri, count)
+		}
+	}
+}
+
+func (u uriCounts) preferred(key string) string {
+	var best string
+	most := 0
+
+	for uri, count := range u[key] {
+		// Ties go to the lowest URI so the result doesn't depend on map
+		// order.
+		if count > most || (count == most && uri < best) {
+			best = uri
+			most = count
+		}
+	}
+
+	return best
+}
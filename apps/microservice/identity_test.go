@@ -0,0 +1,184 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func play(at time.Time, artist, title, album, uri string) Track {
+	return Track{
+		Ts:                            at.Format(timestampLayout),
+		Platform:                      "ios",
+		MsPlayed:                      180_000,
+		ConnCountry:                   "DE",
+		MasterMetadataTrackName:       title,
+		MasterMetadataAlbumArtistName: artist,
+		MasterMetadataAlbumAlbumName:  album,
+		SpotifyTrackUri:               uri,
+		ReasonEnd:                     "trackdone",
+	}
+}
+
+func TestNormalizeTitleDropsRemasterSuffixes(t *testing.T) {
+	tests := map[string]string{
+		"Song":                        "song",
+		"Song - Remastered 2011":      "song",
+		"Song (2009 Remaster)":        "song",
+		"Song - 2009 Remaster":        "song",
+		"Song [Remastered]":           "song",
+		"Song - Digitally Remastered": "song",
+		"Song - Live":                 "song - live",
+		"Song (Remix)":                "song (remix)",
+	}
+
+	for title, want := range tests {
+		if got := normalizeTitle(title); got != want {
+			t.Errorf("normalizeTitle(%q) = %q, want %q", title, got, want)
+		}
+	}
+}
+
+func TestTrackKeys(t *testing.T) {
+	at := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	introA := play(at, "Artist A", "Intro", "A", "spotify:track:a")
+	introB := play(at, "Artist B", "Intro", "B", "spotify:track:b")
+	if trackKey(introA) == trackKey(introB) {
+		t.Error(`"Intro" by two artists shares a key`)
+	}
+
+	debutIntro := play(at, "Artist A", "Intro", "Debut", "spotify:track:c")
+	if trackKey(introA) == trackKey(debutIntro) {
+		t.Error(`"Intro" on two albums by one artist shares a key`)
+	}
+
+	original := play(at, "Artist A", "Song", "A", "spotify:track:1")
+	remasters := []Track{
+		play(at, "Artist A", "Song - Remastered 2011", "A", "spotify:track:2"),
+		play(at, "Artist A", "Song (2009 Remaster)", "A (2009 Remaster)", "spotify:track:3"),
+		play(at, "artist a", "song", "a", "spotify:track:4"),
+	}
+	for _, remaster := range remasters {
+		if trackKey(remaster) != trackKey(original) {
+			t.Errorf("%q on %q is keyed apart from the original", remaster.MasterMetadataTrackName, remaster.MasterMetadataAlbumAlbumName)
+		}
+	}
+
+	hitsA := play(at, "Artist A", "Song", "Greatest Hits", "spotify:track:1")
+	hitsB := play(at, "Artist B", "Song", "Greatest Hits", "spotify:track:3")
+	if albumKey(hitsA) == albumKey(hitsB) {
+		t.Error(`"Greatest Hits" by two artists shares a key`)
+	}
+
+	hitsLower := play(at, "artist a", "Song", "greatest  hits", "spotify:track:1")
+	if albumKey(hitsA) != albumKey(hitsLower) {
+		t.Error("album keys differ by case or spacing")
+	}
+}
+
+func TestPreferredURIIsMostPlayed(t *testing.T) {
+	counts := make(uriCounts)
+	counts.add("song", "spotify:track:old", 2)
+	counts.add("song", "spotify:track:new", 1)
+
+	other := make(uriCounts)
+	other.add("song", "spotify:track:new", 3)
+	counts.merge(other)
+
+	if got := counts.preferred("song"); got != "spotify:track:new" {
+		t.Fatalf("preferred = %s, want spotify:track:new", got)
+	}
+}
+
+func TestCollidingNamesAreReportedSeparately(t *testing.T) {
+	at := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	next := func() time.Time {
+		at = at.Add(4 * time.Minute)
+		return at
+	}
+
+	// Aggregated data leaves out anything played fewer than 10 times.
+	var tracks []Track
+	for i := 0; i < 30; i++ {
+		tracks = append(tracks, play(next(), "Artist A", "Intro", "Greatest Hits", "spotify:track:intro-a"))
+	}
+	for i := 0; i < 20; i++ {
+		tracks = append(tracks, play(next(), "Artist B", "Intro", "Greatest Hits", "spotify:track:intro-b"))
+	}
+
+	// One song under two URIs, the remaster played more often.
+	for i := 0; i < 10; i++ {
+		tracks = append(tracks, play(next(), "Artist A", "Song", "Debut", "spotify:track:song"))
+	}
+	for i := 0; i < 20; i++ {
+		tracks = append(tracks, play(next(), "Artist A", "Song - Remastered 2011", "Debut", "spotify:track:song-2011"))
+	}
+
+	result := analyzeTracks(t, tracks, AnalysisOptions{})
+
+	intros := map[string]TrackData{}
+	for _, track := range result.AggregatedData.TrackPlays {
+		if track.Track == "Intro" {
+			intros[track.Artist] = track
+		}
+	}
+
+	if intros["Artist A"].Count != 30 || intros["Artist A"].Uri != "spotify:track:intro-a" {
+		t.Errorf(`"Intro" by Artist A = %+v, want 30 plays of spotify:track:intro-a`, intros["Artist A"])
+	}
+	if intros["Artist B"].Count != 20 || intros["Artist B"].Uri != "spotify:track:intro-b" {
+		t.Errorf(`"Intro" by Artist B = %+v, want 20 plays of spotify:track:intro-b`, intros["Artist B"])
+	}
+
+	hits := map[string]int{}
+	for _, album := range result.AggregatedData.AlbumPlays {
+		if album.Name == "Greatest Hits" {
+			hits[album.Artist] = album.Count
+		}
+	}
+
+	if hits["Artist A"] != 30 || hits["Artist B"] != 20 {
+		t.Errorf(`"Greatest Hits" plays = %v, want 30 by Artist A and 20 by Artist B`, hits)
+	}
+
+	var song *TrackData
+	for i, track := range result.AggregatedData.TrackPlays {
+		if track.Artist == "Artist A" && track.Track != "Intro" {
+			if song != nil {
+				t.Fatalf("remaster was reported separately: %+v and %+v", *song, track)
+			}
+			song = &result.AggregatedData.TrackPlays[i]
+		}
+	}
+
+	if song == nil || song.Count != 30 || song.Track != "Song" || song.Uri != "spotify:track:song-2011" {
+		t.Errorf("song = %+v, want 30 plays of \"Song\" under spotify:track:song-2011", song)
+	}
+}
+
+func TestSameTitleOnTwoAlbumsIsReportedTwice(t *testing.T) {
+	at := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	var tracks []Track
+	for i := 0; i < 30; i++ {
+		at = at.Add(4 * time.Minute)
+		tracks = append(tracks, play(at, "Artist A", "Intro", "Debut", "spotify:track:intro-debut"))
+	}
+	for i := 0; i < 20; i++ {
+		at = at.Add(4 * time.Minute)
+		tracks = append(tracks, play(at, "Artist A", "Intro", "Second", "spotify:track:intro-second"))
+	}
+
+	result := analyzeTracks(t, tracks, AnalysisOptions{})
+
+	intros := map[string]int{}
+	for _, track := range result.AggregatedData.TrackPlays {
+		if track.Track == "Intro" {
+			intros[track.Uri] = track.Count
+		}
+	}
+
+	if len(intros) != 2 || intros["spotify:track:intro-debut"] != 30 || intros["spotify:track:intro-second"] != 20 {
+		t.Fatalf(`"Intro" plays by URI = %v, want 30 on Debut and 20 on Second`, intros)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+)
+
+var (
+	jsonMarshalerType = reflect.TypeFor[json.Marshaler]()
+	textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+)
+
+// writeJSONStream writes v as the same JSON json.Marshal would, but one
+// struct field and one slice element at a time. json.Encoder marshals the
+// whole value into memory before writing any of it, which for a result with
+// hundreds of thousands of tracks is most of the result a second time.
+func writeJSONStream(w io.Writer, v any) error {
+	return streamValue(w, reflect.ValueOf(v))
+}
+
+func streamValue(w io.Writer, v reflect.Value) error {
+	if !v.IsValid() {
+		_, err := io.WriteString(w, "null")
+		return err
+	}
+
+	t := v.Type()
+	if implementsMarshaler(t) || (v.CanAddr() && implementsMarshaler(reflect.PointerTo(t))) {
+		return writeMarshaled(w, v)
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			_, err := io.WriteString(w, "null")
+			return err
+		}
+		return streamValue(w, v.Elem())
+	case reflect.Struct:
+		return streamStruct(w, v)
+	case reflect.Slice:
+		if v.IsNil() || t.Elem().Kind() == reflect.Uint8 {
+			return writeMarshaled(w, v)
+		}
+		return streamSlice(w, v)
+	default:
+		return writeMarshaled(w, v)
+	}
+}
+
+func streamStruct(w io.Writer, v reflect.Value) error {
+	t := v.Type()
+
+	// Embedded fields and tag options change which fields are written and
+	// how, so leave those structs to encoding/json.
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous || strings.Contains(field.Tag.Get("json"), ",") {
+			return writeMarshaled(w, v)
+		}
+	}
+
+	if _, err := io.WriteString(w, "{"); err != nil {
+		return err
+	}
+
+	first := true
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("json")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		if !first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		first = false
+
+		key, err := json.Marshal(name)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(key, ':')); err != nil {
+			return err
+		}
+
+		if err := streamValue(w, v.Field(i)); err != nil {
+			return err
+		}
+	}
+
+	_, err := io.WriteString(w, "}")
+	return err
+}
+
+func streamSlice(w io.Writer, v reflect.Value) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+
+	for i := 0; i < v.Len(); i++ {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+
+		if err := streamValue(w, v.Index(i)); err != nil {
+			return err
+		}
+	}
+
+	_, err := io.WriteString(w, "]")
+	return err
+}
+
+func implementsMarshaler(t reflect.Type) bool {
+	return t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType)
+}
+
+// writeMarshaled hands v to encoding/json. Addressable values are passed by
+// pointer, as encoding/json would see them, so methods on pointer receivers
+// are used the same way.
+func writeMarshaled(w io.Writer, v reflect.Value) error {
+	if v.CanAddr() {
+		v = v.Addr()
+	}
+
+	data, err := json.Marshal(v.Interface())
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+type pointerMarshaler struct {
+	Value int
+}
+
+func (p *pointerMarshaler) MarshalJSON() ([]byte, error) {
+	return []byte(`"pointer"`), nil
+}
+
+type valueMarshaler struct {
+	Value int
+}
+
+func (v valueMarshaler) MarshalJSON() ([]byte, error) {
+	return []byte(`"value"`), nil
+}
+
+type embeddedFields struct {
+	Name string `json:"name"`
+}
+
+type streamCases struct {
+	Plain      string `json:"plain"`
+	Untagged   int
+	Skipped    string `json:"-"`
+	unexported string
+	Escaped    string               `json:"escaped"`
+	Bytes      []byte               `json:"bytes"`
+	NilSlice   []int                `json:"nil_slice"`
+	Empty      []int                `json:"empty"`
+	Map        map[string]int       `json:"map"`
+	Weekdays   map[time.Weekday]int `json:"weekdays"`
+	Time       time.Time            `json:"time"`
+	Duration   time.Duration        `json:"duration"`
+	Pointer    *pointerMarshaler    `json:"pointer"`
+	ByPointer  pointerMarshaler     `json:"by_pointer"`
+	ByValue    valueMarshaler       `json:"by_value"`
+	NilPointer *int                 `json:"nil_pointer"`
+	Any        interface{}          `json:"any"`
+	Array      [2]string            `json:"array"`
+	Nested     []struct {
+		Kept    int    `json:"kept"`
+		Omitted string `json:"omitted,omitempty"`
+		Quoted  int    `json:"quoted,string"`
+	} `json:"nested"`
+	Embedded struct {
+		embeddedFields
+		Extra int `json:"extra"`
+	} `json:"embedded"`
+}
+
+func assertSameJSON(t *testing.T, v any) {
+	t.Helper()
+
+	want, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got bytes.Buffer
+	if err := writeJSONStream(&got, v); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Fatalf("stream differs from json.Marshal\n got: %s\nwant: %s", got.Bytes(), want)
+	}
+}
+
+func TestJSONStreamMatchesMarshal(t *testing.T) {
+	cases := &streamCases{
+		Plain:      "plain",
+		Untagged:   1,
+		Skipped:    "skipped",
+		unexported: "unexported",
+		Escaped:    `<a href="x">&</a>` + "\u2028",
+		Bytes:      []byte("bytes"),
+		Empty:      []int{},
+		Map:        map[string]int{"b": 2, "a": 1},
+		Weekdays:   map[time.Weekday]int{time.Monday: 1},
+		Time:       time.Date(2023, 1, 2, 3, 4, 5, 6, time.UTC),
+		Duration:   time.Minute,
+		Pointer:    &pointerMarshaler{Value: 1},
+		ByPointer:  pointerMarshaler{Value: 2},
+		ByValue:    valueMarshaler{Value: 3},
+		Any:        map[string]any{"x": []any{1, "y", nil}},
+		Array:      [2]string{"a", "b"},
+	}
+	cases.Nested = make([]struct {
+		Kept    int    `json:"kept"`
+		Omitted string `json:"omitted,omitempty"`
+		Quoted  int    `json:"quoted,string"`
+	}, 2)
+	cases.Nested[1].Omitted = "set"
+	cases.Embedded.Name = "embedded"
+
+	t.Run("pointer", func(t *testing.T) { assertSameJSON(t, cases) })
+	t.Run("value", func(t *testing.T) { assertSameJSON(t, *cases) })
+	t.Run("nil", func(t *testing.T) { assertSameJSON(t, (*streamCases)(nil)) })
+}
+
+func TestJSONStreamMatchesMarshalForResult(t *testing.T) {
+	shuffled, inOrder := true, false
+
+	tracks := testTracks(2_000)
+	for i := range tracks {
+		tracks[i].Skipped = i%4 == 0
+		if i%3 == 0 {
+			tracks[i].Shuffle = &shuffled
+		} else if i%3 == 1 {
+			tracks[i].Shuffle = &inOrder
+		}
+		if i%10 == 0 {
+			tracks[i].MasterMetadataTrackName = ""
+			tracks[i].EpisodeName = "Episode <1>"
+			tracks[i].EpisodeShowName = "Show & Tell"
+			tracks[i].SpotifyEpisodeUri = "spotify:episode:1"
+		}
+	}
+
+	result := analyzeTracks(t, tracks, AnalysisOptions{PlayPolicy: PlayPolicy{MinMs: 40_000}, Timezone: "Europe/Berlin"})
+
+	if len(result.AggregatedData.TrackPlays) == 0 || len(result.Heatmap.DailyCounts) == 0 || len(result.Podcasts.TopShows) == 0 {
+		t.Fatal("result isn't populated enough to compare")
+	}
+
+	assertSameJSON(t, result)
+}
+
+func TestUploadResultDescribesStoredBlob(t *testing.T) {
+	result := analyzeTracks(t, testTracks(1_000), AnalysisOptions{})
+	store := NewMemoryBlobStore()
+
+	body, err := UploadResult(context.Background(), store, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob, size, err := store.Get(context.Background(), body.S3Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+
+	stored, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(stored)
+	if body.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("sha256 = %s, want %x", body.SHA256, sum)
+	}
+
+	if body.UploadSize != size || body.UploadSize != int64(len(stored)) {
+		t.Errorf("upload size = %d, stored blob is %d bytes", body.UploadSize, len(stored))
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(stored))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uncompressed, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body.UncompressedSize != int64(len(uncompressed)) {
+		t.Errorf("uncompressed size = %d, blob holds %d bytes", body.UncompressedSize, len(uncompressed))
+	}
+
+	want, _ := json.Marshal(result)
+	if !bytes.Equal(uncompressed, want) {
+		t.Error("stored result differs from json.Marshal")
+	}
+
+	if !strings.HasSuffix(body.S3Key, result.ProcessID+".json.gz") {
+		t.Errorf("key = %s", body.S3Key)
+	}
+}
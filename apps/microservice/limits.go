@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// JobLimits caps what a single job may consume, so one pathological export
+// can't tie up a worker indefinitely. A zero value means no limit.
+// MaxDiskBytes is charged as the job's zip is written to disk, so it only
+// tightens MaxArchiveBytes when it is set lower.
+type JobLimits struct {
+	MaxDuration          time.Duration
+	MaxArchiveBytes      int64
+	MaxUncompressedBytes int64
+	MaxEntries           int
+	MaxDiskBytes         int64
+}
+
+func DefaultJobLimits() JobLimits {
+	return JobLimits{
+		MaxDuration:          30 * time.Minute,
+		MaxArchiveBytes:      2 << 30,
+		MaxUncompressedBytes: 8 << 30,
+		MaxEntries:           5_000_000,
+		MaxDiskBytes:         10 << 30,
+	}
+}
+
+// WithDeadline bounds ctx by MaxDuration. Once it is up, ctx is cancelled
+// with a *LimitError as its cause.
+func (l JobLimits) WithDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if l.MaxDuration <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeoutCause(ctx, l.MaxDuration, &LimitError{
+		Code:  ErrCodeLimitDuration,
+		Limit: "wall time (ms)",
+		Max:   l.MaxDuration.Milliseconds(),
+	})
+}
+
+// LimitError is returned when a job goes over one of its limits.
+type LimitError struct {
+	Code  ErrorCode
+	Limit string
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("job exceeded %s limit of %d", e.Limit, e.Max)
+}
+
+// JobBudget tracks what a job has used so far across its stages. It is safe
+// for concurrent use.
+type JobBudget struct {
+	limits JobLimits
+
+	mu           sync.Mutex
+	uncompressed int64
+	disk         int64
+	entries      int
+}
+
+func NewJobBudget(limits JobLimits) *JobBudget {
+	return &JobBudget{limits: limits}
+}
+
+// AddDisk records bytes the job keeps on disk, which is its zip whether it
+// was downloaded or uploaded. A negative n gives back bytes that were
+// removed again.
+func (b *JobBudget) AddDisk(n int64) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.disk += n
+
+	if b.limits.MaxDiskBytes > 0 && b.disk > b.limits.MaxDiskBytes {
+		return &LimitError{Code: ErrCodeLimitDisk, Limit: "temp disk bytes", Max: b.limits.MaxDiskBytes}
+	}
+
+	return nil
+}
+
+// AddUncompressed records bytes decompressed out of the archive.
+func (b *JobBudget) AddUncompressed(n int64) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.uncompressed += n
+
+	if b.limits.MaxUncompressedBytes > 0 && b.uncompressed > b.limits.MaxUncompressedBytes {
+		return &LimitError{Code: ErrCodeLimitUncompressed, Limit: "uncompressed bytes", Max: b.limits.MaxUncompressedBytes}
+	}
+
+	return nil
+}
+
+// CheckUncompressed rejects an archive whose entries claim more than the
+// job may decompress, before any of it is read. AddUncompressed still
+// charges the real bytes, since the claimed sizes can lie.
+func (b *JobBudget) CheckUncompressed(size int64) error {
+	if b == nil || b.limits.MaxUncompressedBytes <= 0 || size <= b.limits.MaxUncompressedBytes {
+		return nil
+	}
+
+	return &LimitError{Code: ErrCodeLimitUncompressed, Limit: "uncompressed bytes", Max: b.limits.MaxUncompressedBytes}
+}
+
+// AddEntries records parsed history entries.
+func (b *JobBudget) AddEntries(n int) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.entries += n
+
+	if b.limits.MaxEntries > 0 && b.entries > b.limits.MaxEntries {
+		return &LimitError{Code: ErrCodeLimitEntries, Limit: "history entries", Max: int64(b.limits.MaxEntries)}
+	}
+
+	return nil
+}
+
+// CheckArchive rejects an archive that is larger than allowed.
+func (b *JobBudget) CheckArchive(size int64) error {
+	if b == nil || b.limits.MaxArchiveBytes <= 0 || size <= b.limits.MaxArchiveBytes {
+		return nil
+	}
+
+	return &LimitError{Code: ErrCodeLimitArchiveSize, Limit: "archive bytes", Max: b.limits.MaxArchiveBytes}
+}
+
+// budgetWriter charges everything written through it to a budget, failing
+// the write before the budget is exceeded on disk.
+type budgetWriter struct {
+	w      io.Writer
+	charge func(int64) error
+}
+
+func (bw *budgetWriter) Write(p []byte) (int, error) {
+	if err := bw.charge(int64(len(p))); err != nil {
+		return 0, err
+	}
+
+	return bw.w.Write(p)
+}
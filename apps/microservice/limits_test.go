@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDownloadChargesDisk(t *testing.T) {
+	blobs := NewMemoryBlobStore()
+	blobs.blobs["exports/p1.zip"] = make([]byte, 4096)
+
+	dest := filepath.Join(t.TempDir(), "archive.zip")
+
+	budget := NewJobBudget(JobLimits{MaxDiskBytes: 8192})
+	if err := DownloadBlob(context.Background(), blobs, "exports/p1.zip", dest, budget); err != nil {
+		t.Fatal(err)
+	}
+	if budget.disk != 4096 {
+		t.Fatalf("disk charged = %d, want 4096", budget.disk)
+	}
+
+	budget = NewJobBudget(JobLimits{MaxDiskBytes: 1000})
+	err := DownloadBlob(context.Background(), blobs, "exports/p1.zip", dest, budget)
+
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Code != ErrCodeLimitDisk {
+		t.Fatalf("download over the disk limit = %v, want %s", err, ErrCodeLimitDisk)
+	}
+
+	// The next attempt overwrites the partial file, so it isn't charged twice.
+	if budget.disk != 0 {
+		t.Fatalf("disk charged after a failed download = %d, want 0", budget.disk)
+	}
+}
+
+func TestUploadedZipCountsTowardDisk(t *testing.T) {
+	stub := newMainAppStub(t)
+	dir := t.TempDir()
+
+	store, err := NewFileJobStore(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := newTestQueue(t, dir, NewMemoryBlobStore(), store)
+	q.limits.MaxDiskBytes = 100
+	q.Start()
+	defer stopQueue(t, q, 5*time.Second)
+
+	if err := os.MkdirAll(q.uploadDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestExport(t, filepath.Join(q.uploadDir, "upload-1.zip"), testTracks(100))
+
+	if _, err := q.AddJob(&Job{ProcessID: "p1", UserID: "u1", Upload: "upload-1.zip"}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "failure callback", func() bool {
+		return len(stub.received()) > 0
+	})
+
+	callbacks := stub.received()
+	if len(callbacks) != 1 || callbacks[0].Body.ErrorCode != ErrCodeLimitDisk {
+		t.Fatalf("callbacks = %+v, want one %s failure", callbacks, ErrCodeLimitDisk)
+	}
+}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gofiber/fiber/v2"
 	"github.com/joho/godotenv"
 )
@@ -16,47 +20,133 @@ type Body struct {
 	S3Key     string `json:"s3_key"`
 	ProcessID string `json:"process_id"`
 	UserID    string `json:"user_id"`
+
+	AnalysisOptions
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "analyze" {
+		if err := runAnalyze(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if err := godotenv.Load(); err != nil {
 		log.Println("Warning: No .env found")
 	}
 
-	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
-	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
-	bucketName := os.Getenv("S3_BUCKET_NAME")
-	region := os.Getenv("AWS_REGION")
-	port := os.Getenv("PORT")
+	port := envString("PORT", "8080")
+	queueDir := envString("QUEUE_DIR", "data/queue")
+	deadLetterDir := envString("DEAD_LETTER_DIR", "data/dead-letters")
+	statusDir := envString("STATUS_DIR", "data/status")
+	workDir := envString("WORK_DIR", "data/work")
+	uploadDir := envString("UPLOAD_DIR", "data/uploads")
+	queueDepth := envInt("QUEUE_DEPTH", 100)
+	queueRetryAfter := envDuration("QUEUE_RETRY_AFTER", 30*time.Second)
+	shutdownTimeout := envDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+
+	retryPolicy := DefaultRetryPolicy()
+	retryPolicy.Attempts = envInt("RETRY_MAX_ATTEMPTS", retryPolicy.Attempts)
+	retryPolicy.BaseDelay = envDuration("RETRY_BASE_DELAY", retryPolicy.BaseDelay)
+	retryPolicy.MaxDelay = envDuration("RETRY_MAX_DELAY", retryPolicy.MaxDelay)
 
-	if port == "" {
-		port = "8080"
+	jobLimits := jobLimitsFromEnv()
+	archiveLimits := archiveLimitsFromEnv()
+
+	blobStore, err := blobStoreFromEnv(context.TODO())
+	if err != nil {
+		log.Fatalf("Unable to open blob storage: %v", err)
 	}
 
-	if accessKey == "" || secretKey == "" || region == "" || bucketName == "" {
-		log.Fatal("AWS credentials and region must be set")
+	jobStore, err := NewFileJobStore(queueDir)
+	if err != nil {
+		log.Fatalf("Unable to open job store: %v", err)
 	}
 
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithRegion("us-east-1"),
-		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-			accessKey,
-			secretKey,
-			"",
-		)),
-	)
+	deadLetters, err := NewDeadLetterStore(deadLetterDir)
+	if err != nil {
+		log.Fatalf("Unable to open dead letter store: %v", err)
+	}
 
+	statuses, err := NewStatusStore(statusDir)
 	if err != nil {
-		log.Fatalf("Unable to load SDK config %v:", err)
+		log.Fatalf("Unable to open status store: %v", err)
 	}
 
-	s3Client := s3.NewFromConfig(cfg)
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		log.Fatalf("Unable to create work directory: %v", err)
+	}
 
-	app := fiber.New()
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		log.Fatalf("Unable to create upload directory: %v", err)
+	}
 
-	jobQueue := NewJobQueue(2, s3Client, bucketName)
+	jobQueue := NewJobQueue(QueueConfig{
+		Workers:     2,
+		Depth:       queueDepth,
+		Blobs:       blobStore,
+		Store:       jobStore,
+		DeadLetters: deadLetters,
+		Statuses:    statuses,
+		Retry:       retryPolicy,
+		WorkDir:     workDir,
+		UploadDir:   uploadDir,
+		Limits:      jobLimits,
+		Archive:     archiveLimits,
+	})
 	jobQueue.Start()
 
+	app := newApp(jobQueue, serverConfig{
+		UploadDir:       uploadDir,
+		JobLimits:       jobLimits,
+		QueueRetryAfter: queueRetryAfter,
+	})
+
+	go func() {
+		if err := app.Listen(":" + port); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+
+	<-shutdown
+
+	// Stop taking jobs first but keep serving the status endpoints while
+	// the workers drain.
+	log.Printf("Shutting down, waiting up to %s for running jobs", shutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := jobQueue.Stop(ctx); err != nil {
+		log.Printf("Queue did not drain cleanly: %v", err)
+	}
+
+	if err := app.ShutdownWithTimeout(5 * time.Second); err != nil {
+		log.Printf("Failed to shut down server: %v", err)
+	}
+}
+
+// serverConfig is what the HTTP handlers need besides the queue.
+type serverConfig struct {
+	UploadDir       string
+	JobLimits       JobLimits
+	QueueRetryAfter time.Duration
+}
+
+func newApp(jobQueue *Queue, cfg serverConfig) *fiber.App {
+	// Uploads are streamed to disk rather than buffered, anything bigger
+	// than the body limit is read as the handler goes. limitBody keeps the
+	// limit for every other route.
+	app := fiber.New(fiber.Config{
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+	})
+
+	app.Use(limitBody(fiber.DefaultBodyLimit, "/process/upload"))
 	app.Use(authChecker)
 
 	app.Post("/process", func(c *fiber.Ctx) error {
@@ -74,26 +164,275 @@ func main() {
 			})
 		}
 
+		if err := body.AnalysisOptions.Validate(); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"message": err.Error(),
+			})
+		}
+
 		job := &Job{
-			S3Key:     body.S3Key,
-			ProcessID: body.ProcessID,
-			UserID:    body.UserID,
+			S3Key:          body.S3Key,
+			ProcessID:      body.ProcessID,
+			UserID:         body.UserID,
+			IdempotencyKey: c.Get("Idempotency-Key"),
+			Options:        body.AnalysisOptions,
 		}
 
-		jobQueue.AddJob(job)
+		position, err := jobQueue.AddJob(job)
+
+		return addJobResponse(c, job, position, err, cfg.QueueRetryAfter)
+	})
+
+	// /process/upload takes the export itself instead of an S3 key, for
+	// deployments without S3. See ReceiveUpload for the form fields. A job
+	// the queue would turn away is rejected before the zip is read.
+	app.Post("/process/upload", func(c *fiber.Ctx) error {
+		var job *Job
+
+		upload, err := ReceiveUpload(
+			c.Context(),
+			c.Context().RequestBodyStream(),
+			c.Get(fiber.HeaderContentType),
+			cfg.UploadDir,
+			NewJobBudget(cfg.JobLimits),
+			func(upload *Upload) error {
+				job = &Job{
+					ProcessID:      upload.ProcessID,
+					UserID:         upload.UserID,
+					IdempotencyKey: c.Get("Idempotency-Key"),
+				}
+				return jobQueue.CheckJob(job)
+			},
+		)
+
+		var duplicate *DuplicateJobError
+		if errors.As(err, &duplicate) || errors.Is(err, ErrQueueFull) || errors.Is(err, ErrQueueClosed) {
+			return addJobResponse(c, job, 0, err, cfg.QueueRetryAfter)
+		}
+
+		var limitErr *LimitError
+		if errors.As(err, &limitErr) {
+			return c.Status(413).JSON(fiber.Map{
+				"message": err.Error(),
+			})
+		}
+
+		if errors.Is(err, ErrInvalidUpload) || errors.Is(err, ErrChecksumMismatch) {
+			return c.Status(400).JSON(fiber.Map{
+				"message": err.Error(),
+			})
+		}
+
+		if err != nil {
+			log.Printf("Failed to receive upload: %v", err)
+			return c.Status(500).JSON(fiber.Map{
+				"message": "Could not receive upload",
+			})
+		}
+
+		job = upload.Job()
+		job.IdempotencyKey = c.Get("Idempotency-Key")
+
+		position, err := jobQueue.AddJob(job)
+		if err != nil {
+			upload.discard()
+		}
+
+		return addJobResponse(c, job, position, err, cfg.QueueRetryAfter)
+	})
+
+	app.Get("/jobs/:processId", func(c *fiber.Ctx) error {
+		state, ok := jobQueue.Status(c.Params("processId"))
+		if !ok {
+			return c.Status(404).JSON(fiber.Map{
+				"message": "Job not found",
+			})
+		}
+
+		return c.JSON(state)
+	})
+
+	admin := app.Group("/admin", adminAuthChecker)
+
+	admin.Get("/dead-letters", func(c *fiber.Ctx) error {
+		letters, err := jobQueue.DeadLetters()
+		if err != nil {
+			log.Printf("Failed to list dead letters: %v", err)
+			return c.Status(500).JSON(fiber.Map{
+				"message": "Could not list dead letters",
+			})
+		}
+
+		if userID := c.Query("user_id"); userID != "" {
+			filtered := make([]*DeadLetter, 0, len(letters))
+			for _, letter := range letters {
+				if letter.Job.UserID == userID {
+					filtered = append(filtered, letter)
+				}
+			}
+			letters = filtered
+		}
+
+		return c.JSON(fiber.Map{
+			"dead_letters": letters,
+		})
+	})
+
+	admin.Post("/dead-letters/:id/replay", func(c *fiber.Ctx) error {
+		err := jobQueue.Replay(c.Params("id"))
+
+		var duplicate *DuplicateJobError
+		if errors.As(err, &duplicate) {
+			return c.Status(409).JSON(fiber.Map{
+				"message": "Job is already queued or running",
+				"job":     duplicate.State,
+			})
+		}
+
+		if errors.Is(err, ErrDeadLetterNotFound) {
+			return c.Status(404).JSON(fiber.Map{
+				"message": "Dead letter not found",
+			})
+		}
+
+		if errors.Is(err, ErrQueueFull) {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(cfg.QueueRetryAfter.Seconds())))
+			return c.Status(429).JSON(fiber.Map{
+				"message": "Queue is full, try again later",
+			})
+		}
+
+		if errors.Is(err, ErrQueueClosed) {
+			return c.Status(503).JSON(fiber.Map{
+				"message": "Service is shutting down",
+			})
+		}
+
+		if err != nil {
+			log.Printf("Failed to replay dead letter %s: %v", c.Params("id"), err)
+			return c.Status(500).JSON(fiber.Map{
+				"message": "Could not replay job",
+			})
+		}
 
 		return c.JSON(fiber.Map{
 			"message": "Job added to queue",
 		})
 	})
 
+	app.Delete("/jobs/:processId", func(c *fiber.Ctx) error {
+		state, err := jobQueue.Cancel(c.Params("processId"))
+
+		if errors.Is(err, ErrJobNotFound) {
+			return c.Status(404).JSON(fiber.Map{
+				"message": "Job not found",
+			})
+		}
+
+		if errors.Is(err, ErrJobFinished) {
+			return c.Status(409).JSON(fiber.Map{
+				"message": "Job has already finished",
+				"job":     state,
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"message": "Job cancelled",
+			"job":     state,
+		})
+	})
+
 	app.Get("/health", func(c *fiber.Ctx) error {
 		return c.JSON(fiber.Map{
 			"message": "successfully running",
 		})
 	})
 
-	log.Fatal(app.Listen(":" + port))
+	return app
+}
+
+// limitBody reads the body of every route but the streamed ones, and
+// rejects it once it is bigger than limit. With request bodies streamed
+// nothing else stops c.Body from reading a body of any size into memory.
+// A streamed route that answers with an error usually leaves the rest of
+// its body unread, which would otherwise be parsed as the next request on
+// the connection, so that connection is closed.
+func limitBody(limit int, streamed ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if slices.Contains(streamed, c.Path()) {
+			err := c.Next()
+			if err != nil || c.Response().StatusCode() >= 400 {
+				c.Context().SetConnectionClose()
+			}
+			return err
+		}
+
+		tooLarge := func() error {
+			c.Context().SetConnectionClose()
+			return c.Status(413).JSON(fiber.Map{
+				"message": "Request body too large",
+			})
+		}
+
+		if c.Request().Header.ContentLength() > limit {
+			return tooLarge()
+		}
+
+		if stream := c.Context().RequestBodyStream(); stream != nil {
+			body, err := io.ReadAll(io.LimitReader(stream, int64(limit)+1))
+			if err != nil {
+				c.Context().SetConnectionClose()
+				return c.Status(400).JSON(fiber.Map{
+					"message": "Invalid request",
+				})
+			}
+
+			if len(body) > limit {
+				return tooLarge()
+			}
+
+			c.Request().SetBody(body)
+		}
+
+		return c.Next()
+	}
+}
+
+// addJobResponse answers a request that tried to add job to the queue, with
+// err being what AddJob returned.
+func addJobResponse(c *fiber.Ctx, job *Job, position int, err error, retryAfter time.Duration) error {
+	var duplicate *DuplicateJobError
+	if errors.As(err, &duplicate) {
+		return c.JSON(fiber.Map{
+			"message": "Job already exists",
+			"job":     duplicate.State,
+		})
+	}
+
+	if errors.Is(err, ErrQueueFull) {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(retryAfter.Seconds())))
+		return c.Status(429).JSON(fiber.Map{
+			"message": "Queue is full, try again later",
+		})
+	}
+
+	if errors.Is(err, ErrQueueClosed) {
+		return c.Status(503).JSON(fiber.Map{
+			"message": "Service is shutting down",
+		})
+	}
+
+	if err != nil {
+		log.Printf("Failed to add job %s: %v", job.ProcessID, err)
+		return c.Status(500).JSON(fiber.Map{
+			"message": "Could not queue job",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":  "Job added to queue",
+		"position": position,
+	})
 }
 
 func authChecker(c *fiber.Ctx) error {
@@ -108,3 +447,18 @@ func authChecker(c *fiber.Ctx) error {
 
 	return c.Next()
 }
+
+// adminAuthChecker guards the admin endpoints with their own key, on top of
+// the app key. They are disabled when ADMIN_AUTH_KEY is not set.
+func adminAuthChecker(c *fiber.Ctx) error {
+	adminKey := c.Get("x-admin-key")
+	secretKey := os.Getenv("ADMIN_AUTH_KEY")
+
+	if secretKey == "" || adminKey != secretKey {
+		return c.Status(401).JSON(fiber.Map{
+			"message": "Bad Authentication",
+		})
+	}
+
+	return c.Next()
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// newTestApp serves an unstarted queue, so whatever is added stays queued.
+func newTestApp(t *testing.T, limits JobLimits) (*fiber.App, *Queue) {
+	t.Helper()
+	t.Setenv("APP_AUTH_KEY", "test")
+
+	dir := t.TempDir()
+
+	store, err := NewFileJobStore(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := newTestQueue(t, dir, NewMemoryBlobStore(), store)
+
+	return newTestServer(t, q, limits), q
+}
+
+func newTestServer(t *testing.T, q *Queue, limits JobLimits) *fiber.App {
+	t.Helper()
+	t.Setenv("APP_AUTH_KEY", "test")
+
+	if err := os.MkdirAll(q.uploadDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	return newApp(q, serverConfig{
+		UploadDir:       q.uploadDir,
+		JobLimits:       limits,
+		QueueRetryAfter: 30 * time.Second,
+	})
+}
+
+// send runs req through app and decodes the JSON response body.
+func send(t *testing.T, app *fiber.App, req *http.Request) (*http.Response, map[string]any) {
+	t.Helper()
+
+	req.Header.Set("x-api-key", "test")
+
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decoding %d response: %v", resp.StatusCode, err)
+	}
+
+	return resp, body
+}
+
+func uploadRequest(t *testing.T, processID, zip, sum string) *http.Request {
+	t.Helper()
+
+	body, contentType := uploadBody(t,
+		uploadPart{"process_id", processID},
+		uploadPart{"user_id", "u1"},
+		uploadPart{"sha256", sum},
+		uploadPart{"file", zip},
+	)
+
+	req := httptest.NewRequest("POST", "/process/upload", body)
+	req.Header.Set("Content-Type", contentType)
+	return req
+}
+
+func TestUploadEndpoint(t *testing.T) {
+	zip := string(testExportBytes(t, testTracks(10)))
+
+	tests := []struct {
+		name    string
+		limits  JobLimits
+		prepare func(t *testing.T, q *Queue)
+		sum     string
+		status  int
+		check   func(t *testing.T, resp *http.Response, body map[string]any)
+	}{
+		{
+			name:   "accepted",
+			status: 200,
+			check: func(t *testing.T, resp *http.Response, body map[string]any) {
+				if body["position"] != 1.0 {
+					t.Errorf("position = %v, want 1", body["position"])
+				}
+			},
+		},
+		{
+			name: "duplicate",
+			prepare: func(t *testing.T, q *Queue) {
+				if _, err := q.AddJob(&Job{S3Key: "exports/p1.zip", ProcessID: "p1", UserID: "u1"}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			status: 200,
+			check: func(t *testing.T, resp *http.Response, body map[string]any) {
+				job, _ := body["job"].(map[string]any)
+				if body["message"] != "Job already exists" || job["process_id"] != "p1" {
+					t.Errorf("body = %v, want the existing job", body)
+				}
+			},
+		},
+		{
+			name: "queue full",
+			prepare: func(t *testing.T, q *Queue) {
+				for i := 0; i < cap(q.jobs); i++ {
+					job := &Job{S3Key: "exports/other.zip", ProcessID: fmt.Sprintf("other-%d", i), UserID: "u2"}
+					if _, err := q.AddJob(job); err != nil {
+						t.Fatal(err)
+					}
+				}
+			},
+			status: 429,
+			check: func(t *testing.T, resp *http.Response, body map[string]any) {
+				if got := resp.Header.Get("Retry-After"); got != "30" {
+					t.Errorf("Retry-After = %q, want 30", got)
+				}
+			},
+		},
+		{
+			name:   "too large",
+			limits: JobLimits{MaxArchiveBytes: 64},
+			status: 413,
+		},
+		{
+			name:   "checksum mismatch",
+			sum:    checksum("something else"),
+			status: 400,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limits := DefaultJobLimits()
+			if tt.limits.MaxArchiveBytes != 0 {
+				limits = tt.limits
+			}
+
+			app, q := newTestApp(t, limits)
+			if tt.prepare != nil {
+				tt.prepare(t, q)
+			}
+
+			sum := tt.sum
+			if sum == "" {
+				sum = checksum(zip)
+			}
+
+			resp, body := send(t, app, uploadRequest(t, "p1", zip, sum))
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d (%v), want %d", resp.StatusCode, body, tt.status)
+			}
+			if tt.check != nil {
+				tt.check(t, resp, body)
+			}
+
+			if tt.status != 200 {
+				if !resp.Close {
+					t.Error("connection left open after a rejected upload")
+				}
+				assertEmptyDir(t, q.uploadDir)
+			}
+		})
+	}
+}
+
+func TestUploadRejectsInvalidOptions(t *testing.T) {
+	app, q := newTestApp(t, DefaultJobLimits())
+
+	body, contentType := uploadBody(t,
+		uploadPart{"process_id", "p1"},
+		uploadPart{"user_id", "u1"},
+		uploadPart{"options", `{"timezone": "Mars/Olympus_Mons"}`},
+		uploadPart{"file", "not really a zip"},
+	)
+	req := httptest.NewRequest("POST", "/process/upload", body)
+	req.Header.Set("Content-Type", contentType)
+
+	resp, _ := send(t, app, req)
+	if resp.StatusCode != 400 {
+		t.Fatalf("status = %d, want 400", resp.StatusCode)
+	}
+
+	assertEmptyDir(t, q.uploadDir)
+}
+
+func TestJSONBodyIsLimited(t *testing.T) {
+	app, _ := newTestApp(t, DefaultJobLimits())
+
+	padding := strings.Repeat(" ", fiber.DefaultBodyLimit)
+	body := `{"s3_key": "exports/p1.zip", "process_id": "p1", "user_id": "u1"}` + padding
+
+	// Sent chunked, so only reading the body tells how big it is.
+	req := httptest.NewRequest("POST", "/process", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+
+	resp, _ := send(t, app, req)
+	if resp.StatusCode != 413 {
+		t.Fatalf("status = %d, want 413", resp.StatusCode)
+	}
+
+	req = httptest.NewRequest("POST", "/process", strings.NewReader(strings.TrimSpace(body)))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, _ = send(t, app, req)
+	if resp.StatusCode != 200 {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func getJob(t *testing.T, app *fiber.App, processID string) (int, JobState) {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", "/jobs/"+processID, nil)
+	req.Header.Set("x-api-key", "test")
+
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var state JobState
+	if resp.StatusCode == 200 {
+		if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return resp.StatusCode, state
+}
+
+func TestJobStatusEndpoint(t *testing.T) {
+	app, q := newTestApp(t, DefaultJobLimits())
+
+	if status, _ := getJob(t, app, "p1"); status != 404 {
+		t.Fatalf("unknown job = %d, want 404", status)
+	}
+
+	if _, err := q.AddJob(&Job{S3Key: "exports/p1.zip", ProcessID: "p1", UserID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	status, state := getJob(t, app, "p1")
+	if status != 200 {
+		t.Fatalf("queued job = %d, want 200", status)
+	}
+	if state.ProcessID != "p1" || state.UserID != "u1" || state.Status != StatusQueued ||
+		len(state.History) != 1 || state.History[0].Status != StatusQueued || state.CreatedAt.IsZero() {
+		t.Fatalf("body = %+v, want p1 of u1 queued", state)
+	}
+}
+
+func TestJobStatusSurvivesRestart(t *testing.T) {
+	stub := newMainAppStub(t)
+	dir := t.TempDir()
+
+	store, err := NewFileJobStore(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := NewMemoryBlobStore()
+	blobs.blobs["exports/done.zip"] = testExportBytes(t, testTracks(10))
+
+	q := newTestQueue(t, dir, blobs, store)
+	q.Start()
+
+	if _, err := q.AddJob(&Job{S3Key: "exports/done.zip", ProcessID: "done", UserID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "first job to complete", func() bool {
+		return len(stub.received()) > 0
+	})
+
+	if err := stopQueue(t, q, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Left in the store, as if the process went down before running it.
+	waiting := &Job{S3Key: "exports/waiting.zip", ProcessID: "waiting", UserID: "u1", EnqueuedAt: time.Now()}
+	if err := store.Save(waiting); err != nil {
+		t.Fatal(err)
+	}
+
+	blocking := &blockingBlobStore{started: make(chan string, 1)}
+	restarted := newTestQueue(t, dir, blocking, store)
+	restarted.Start()
+	defer stopQueue(t, restarted, 100*time.Millisecond)
+
+	app := newTestServer(t, restarted, DefaultJobLimits())
+
+	status, state := getJob(t, app, "done")
+	if status != 200 || state.Status != StatusCompleted || state.FinishedAt == nil {
+		t.Fatalf("finished job after restart = %d %+v, want it completed", status, state)
+	}
+
+	<-blocking.started
+
+	status, state = getJob(t, app, "waiting")
+	if status != 200 || state.Status != StatusDownloading || state.Attempts != 1 {
+		t.Fatalf("resumed job after restart = %d %+v, want it downloading on attempt 1", status, state)
+	}
+
+	body := strings.NewReader(`{"s3_key": "exports/done.zip", "process_id": "done", "user_id": "u1"}`)
+	req := httptest.NewRequest("POST", "/process", body)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, response := send(t, app, req)
+	if resp.StatusCode != 200 || response["message"] != "Job already exists" {
+		t.Fatalf("resubmitting a finished job after restart = %d %v, want a duplicate", resp.StatusCode, response)
+	}
+}
+
+func processRequest(processID, idempotencyKey string) *http.Request {
+	body := fmt.Sprintf(`{"s3_key": "exports/%s.zip", "process_id": %q, "user_id": "u1"}`, processID, processID)
+
+	req := httptest.NewRequest("POST", "/process", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	return req
+}
+
+func TestProcessAnswersFullQueueWithRetryAfter(t *testing.T) {
+	app, q := newTestApp(t, DefaultJobLimits())
+
+	for i := 0; i < cap(q.jobs); i++ {
+		resp, body := send(t, app, processRequest(fmt.Sprintf("p%d", i), ""))
+		if resp.StatusCode != 200 || body["position"] != float64(i+1) {
+			t.Fatalf("job %d = %d %v, want it queued at %d", i, resp.StatusCode, body, i+1)
+		}
+	}
+
+	resp, body := send(t, app, processRequest("late", ""))
+	if resp.StatusCode != 429 || resp.Header.Get("Retry-After") != "30" {
+		t.Fatalf("job on a full queue = %d %v (Retry-After %q), want 429 after 30s",
+			resp.StatusCode, body, resp.Header.Get("Retry-After"))
+	}
+
+	// Turned away entirely, so trying again later isn't a duplicate.
+	if status, _ := getJob(t, app, "late"); status != 404 {
+		t.Fatalf("rejected job = %d, want 404", status)
+	}
+	if pending, _ := q.store.Pending(); len(pending) != cap(q.jobs) {
+		t.Fatalf("%d jobs stored, want %d", len(pending), cap(q.jobs))
+	}
+}
+
+func TestDuplicateSubmissionReturnsExistingJob(t *testing.T) {
+	app, _ := newTestApp(t, DefaultJobLimits())
+
+	if resp, body := send(t, app, processRequest("p1", "key-1")); resp.StatusCode != 200 || body["position"] != 1.0 {
+		t.Fatalf("first submission = %d %v, want it queued", resp.StatusCode, body)
+	}
+
+	zip := string(testExportBytes(t, testTracks(10)))
+
+	upload := uploadRequest(t, "p3", zip, checksum(zip))
+	upload.Header.Set("Idempotency-Key", "key-1")
+
+	tests := []struct {
+		name string
+		req  *http.Request
+	}{
+		{"same process id", processRequest("p1", "")},
+		{"same idempotency key", processRequest("p2", "key-1")},
+		{"upload with the same idempotency key", upload},
+	}
+
+	for _, tt := range tests {
+		resp, body := send(t, app, tt.req)
+
+		job, _ := body["job"].(map[string]any)
+		if resp.StatusCode != 200 || body["message"] != "Job already exists" ||
+			job["process_id"] != "p1" || job["status"] != string(StatusQueued) {
+			t.Errorf("%s = %d %v, want the queued p1", tt.name, resp.StatusCode, body)
+		}
+	}
+
+	for _, id := range []string{"p2", "p3"} {
+		if status, _ := getJob(t, app, id); status != 404 {
+			t.Errorf("duplicate %s = %d, want it not queued", id, status)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// AnalysisOptions are what a caller can tune about how a job's history is
+// analyzed. They travel with the job, so a replayed or resumed job is
+// analyzed the same way.
+type AnalysisOptions struct {
+	PlayPolicy PlayPolicy `json:"play_policy"`
+
+	// Timezone is the IANA zone time of day, weekdays and dates are bucketed
+	// in. Defaults to UTC.
+	Timezone string `json:"timezone,omitempty"`
+
+	// InferTimezone buckets plays streamed from another country in that
+	// country's zone instead, for users who travel.
+	InferTimezone bool `json:"infer_timezone,omitempty"`
+}
+
+func (o AnalysisOptions) Validate() error {
+	// "Local" would mean whatever zone this host happens to be in.
+	if o.Timezone != "" {
+		if _, err := time.LoadLocation(o.Timezone); err != nil || o.Timezone == "Local" {
+			return fmt.Errorf("unknown timezone %q", o.Timezone)
+		}
+	}
+
+	return o.PlayPolicy.Validate()
+}
+
+// PlayPolicy decides which entries count as a play. Entries that don't still
+// count towards listening time, and towards the raw counts reported next to
+// the qualified ones. The zero value counts everything.
+//
+// The exports don't include track lengths, so there is no rule based on how
+// much of a track was played.
+type PlayPolicy struct {
+	// MinMs is how long an entry must have played for. Spotify itself counts
+	// a stream after 30 seconds.
+	MinMs int `json:"min_ms"`
+
+	// ExcludeSkipped drops entries Spotify marked as skipped.
+	ExcludeSkipped bool `json:"exclude_skipped"`
+
+	// ExcludeReasonEnd drops entries that ended for one of these reasons,
+	// e.g. "fwdbtn" or "backbtn".
+	ExcludeReasonEnd []string `json:"exclude_reason_end,omitempty"`
+}
+
+func (p PlayPolicy) Validate() error {
+	if p.MinMs < 0 {
+		return fmt.Errorf("min_ms must not be negative")
+	}
+
+	return nil
+}
+
+// Qualifies reports whether the entry counts as a play under the policy.
+func (p PlayPolicy) Qualifies(track Track) bool {
+	if track.MsPlayed < p.MinMs {
+		return false
+	}
+
+	if p.ExcludeSkipped && track.Skipped {
+		return false
+	}
+
+	if track.ReasonEnd != "" && slices.Contains(p.ExcludeReasonEnd, track.ReasonEnd) {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestPlayPolicyAppliesToTimeBasedStats(t *testing.T) {
+	var tracks []Track
+
+	// Five real plays in the afternoon...
+	afternoon := time.Date(2023, 1, 1, 15, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		tracks = append(tracks, play(afternoon.Add(time.Duration(i)*3*time.Minute), "Artist A", "Song", "Album", "spotify:track:1"))
+	}
+
+	// ...and a longer run of taps the next night that the policy drops.
+	night := time.Date(2023, 1, 2, 3, 0, 0, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		tap := play(night.Add(time.Duration(i)*time.Minute), "Artist B", "Other", "Album", "spotify:track:2")
+		tap.MsPlayed = 200
+		tracks = append(tracks, tap)
+	}
+
+	result := analyzeTracks(t, tracks, AnalysisOptions{PlayPolicy: PlayPolicy{MinMs: 30_000}})
+
+	if result.TotalTracks != 5 || result.RawTotalTracks != 25 {
+		t.Errorf("tracks = %d of %d raw, want 5 of 25", result.TotalTracks, result.RawTotalTracks)
+	}
+
+	if result.PeakHour != 15 {
+		t.Errorf("peak hour = %d, want 15", result.PeakHour)
+	}
+
+	counted := 0
+	for _, day := range result.Heatmap.DailyCounts {
+		counted += day.Count
+		if day.Date == "2023-01-02" && day.Count != 0 {
+			t.Errorf("heatmap counts %d plays on the night of taps", day.Count)
+		}
+	}
+	if counted != 5 {
+		t.Errorf("heatmap counts %d plays, want 5", counted)
+	}
+
+	data, err := json.Marshal(result.LongestSession)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var session struct {
+		TotalSessions int `json:"totalSessions"`
+		Insights      struct {
+			TotalTracks int `json:"total_tracks"`
+		} `json:"session_insights"`
+	}
+	if err := json.Unmarshal(data, &session); err != nil {
+		t.Fatal(err)
+	}
+
+	if session.TotalSessions != 1 || session.Insights.TotalTracks != 5 {
+		t.Errorf("sessions = %d with %d tracks in the longest, want 1 with 5", session.TotalSessions, session.Insights.TotalTracks)
+	}
+}
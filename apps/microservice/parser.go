@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Entries are handed to the aggregation workers in batches of this size, so
+// only a handful of batches are ever held in memory at once.
+const parseBatchSize = 1024
+
+const timestampLayout = "2006-01-02T15:04:05Z"
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// playEntry is a decoded history entry along with its parsed timestamp, in
+// the zone its plays are bucketed in.
+type playEntry struct {
+	Track
+	at        time.Time
+	valid     bool
+	qualified bool
+}
+
+// ListeningHistory is everything accumulated while streaming the history
+// files, ready to be turned into a ProcessResult.
+type ListeningHistory struct {
+	totals   *aggregation
+	timeline *sessionTracker
+	sessions *sessionSummary
+	formats  map[HistoryFormat]int
+	policy   PlayPolicy
+	timezone string
+}
+
+// ParseListeningHistoryFiles streams every entry out of the history files
+// and into the aggregation workers as it is decoded. The decoded entries
+// aren't kept: memory grows with the number of distinct tracks and artists
+// in the aggregation maps, the size of the largest file and the number of
+// listening sessions, but not with the number of entries.
+func ParseListeningHistoryFiles(ctx context.Context, historyFiles []*HistoryFile, options AnalysisOptions, budget *JobBudget) (*ListeningHistory, error) {
+	log.Println("Starting Parse")
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+
+	availableWorkers := runtime.NumCPU()
+
+	history := &ListeningHistory{
+		totals:   newAggregation(),
+		timeline: new(sessionTracker),
+		formats:  make(map[HistoryFormat]int),
+		policy:   options.PlayPolicy,
+	}
+
+	zones, err := newZoneResolver(options)
+	if err != nil {
+		return nil, err
+	}
+
+	history.timezone = zones.home.String()
+
+	batches := make(chan []playEntry, availableWorkers*2)
+
+	for i := 0; i < availableWorkers; i++ {
+		wg.Add(1)
+		go worker(batches, &wg, &mutex, history.totals)
+	}
+
+	err = streamEntries(ctx, historyFiles, budget, history, zones, batches)
+
+	close(batches)
+	wg.Wait()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if history.totals.entries == 0 {
+		return nil, fmt.Errorf("no valid entries found in any of the JSON files")
+	}
+
+	history.sessions, err = history.timeline.summarize(ctx, history.policy, zones.home)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Processed a total of %d tracks from all files", history.totals.entries)
+
+	return history, nil
+}
+
+func streamEntries(ctx context.Context, historyFiles []*HistoryFile, budget *JobBudget, history *ListeningHistory, zones *zoneResolver, batches chan<- []playEntry) error {
+	batch := make([]playEntry, 0, parseBatchSize)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := budget.AddEntries(len(batch)); err != nil {
+			return err
+		}
+
+		select {
+		case batches <- batch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		batch = make([]playEntry, 0, parseBatchSize)
+
+		return nil
+	}
+
+	for _, historyFile := range historyFiles {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		log.Printf("Processing JSON file: %s", historyFile.Name)
+
+		count := 0
+
+		format, err := decodeHistoryFile(historyFile, func(track Track) error {
+			entry := playEntry{Track: track, qualified: history.policy.Qualifies(track)}
+
+			timestamp, err := time.Parse(timestampLayout, track.Ts)
+			if err != nil {
+				log.Println("Error parsing date:", err)
+			} else {
+				entry.at = timestamp.In(zones.locate(track.ConnCountry))
+				entry.valid = true
+
+				// Sessions are made of plays, so entries the policy
+				// doesn't count can't make one longer.
+				if entry.qualified {
+					history.timeline.add(timestamp)
+				}
+			}
+
+			batch = append(batch, entry)
+			count++
+
+			if len(batch) == parseBatchSize {
+				return flush()
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			// Anything that isn't a problem with this file's JSON stops the
+			// whole job. A file that turns out malformed partway keeps the
+			// entries decoded before the error: they may already be with the
+			// workers, and holding a whole file back until it decodes cleanly
+			// would undo streaming it. The rest of the file is skipped.
+			if !isMalformedJSON(err) {
+				return err
+			}
+
+			log.Printf("Error parsing JSON in %s: %v", historyFile.Name, err)
+		}
+
+		history.timeline.endFile(historyFile)
+		history.formats[format] += count
+
+		log.Printf("Found %d tracks in file %s (%s format)", count, historyFile.Name, format)
+	}
+
+	return flush()
+}
+
+var errNotHistoryArray = errors.New("file is not a JSON array")
+
+func isMalformedJSON(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	return errors.As(err, &syntaxErr) ||
+		errors.As(err, &typeErr) ||
+		errors.Is(err, errNotHistoryArray) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// decodeHistoryFile decodes the file's top level array one entry at a time,
+// normalizing each entry into a Track. It returns the format the file turned
+// out to be in.
+func decodeHistoryFile(historyFile *HistoryFile, emit func(Track) error) (HistoryFormat, error) {
+	format := historyFile.Format
+
+	rc, err := historyFile.Open()
+	if err != nil {
+		return format, err
+	}
+	defer rc.Close()
+
+	reader := bufio.NewReader(rc)
+
+	// Check for UTF-8 BOM and skip if present
+	if prefix, err := reader.Peek(len(utf8BOM)); err == nil && bytes.Equal(prefix, utf8BOM) {
+		reader.Discard(len(utf8BOM))
+	}
+
+	decoder := json.NewDecoder(reader)
+
+	token, err := decoder.Token()
+	if err != nil {
+		return format, err
+	}
+
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return format, errNotHistoryArray
+	}
+
+	for decoder.More() {
+		track, err := readEntry(decoder, &format)
+		if err != nil {
+			return format, err
+		}
+
+		if err := emit(track); err != nil {
+			return format, err
+		}
+	}
+
+	_, err = decoder.Token()
+
+	return format, err
+}
+
+// format is the format most of the entries were in.
+func (h *ListeningHistory) format() HistoryFormat {
+	format := FormatUnknown
+	most := 0
+
+	for f, count := range h.formats {
+		if count > most {
+			format = f
+			most = count
+		}
+	}
+
+	return format
+}
+
+// sessionGap is how long a pause has to be to end a listening session.
+const sessionGap = int64(time.Hour / time.Second)
+
+// sessionSpan is a run of plays, in Unix seconds, with no pause of
+// sessionGap or longer in it.
+type sessionSpan struct {
+	start int64
+	end   int64
+}
+
+func (s sessionSpan) duration() time.Duration {
+	return time.Duration(s.end-s.start) * time.Second
+}
+
+// fileSpan is when a file's plays start and end.
+type fileSpan struct {
+	sessionSpan
+	file *HistoryFile
+}
+
+// sessionTracker finds listening sessions without keeping every play. The
+// plays of one file at a time are sorted and cut into sessions, and only
+// their spans are kept. Spans from different files are merged at the end,
+// which gives the same sessions as sorting every play at once, since no
+// span reaches across a pause with nothing played in it. Memory grows with
+// the size of the largest file and the number of sessions, not with the
+// number of plays.
+type sessionTracker struct {
+	plays []int64
+	spans []sessionSpan
+	files []fileSpan
+}
+
+func (t *sessionTracker) add(at time.Time) {
+	t.plays = append(t.plays, at.Unix())
+}
+
+// endFile cuts the plays added since the last call into sessions.
+func (t *sessionTracker) endFile(file *HistoryFile) {
+	if len(t.plays) == 0 {
+		return
+	}
+
+	slices.Sort(t.plays)
+
+	span := sessionSpan{start: t.plays[0], end: t.plays[0]}
+	for _, at := range t.plays[1:] {
+		if at-span.end >= sessionGap {
+			t.spans = append(t.spans, span)
+			span = sessionSpan{start: at, end: at}
+			continue
+		}
+
+		span.end = at
+	}
+	t.spans = append(t.spans, span)
+
+	t.files = append(t.files, fileSpan{
+		sessionSpan: sessionSpan{start: t.plays[0], end: t.plays[len(t.plays)-1]},
+		file:        file,
+	})
+
+	t.plays = t.plays[:0]
+}
+
+// longest merges the spans of every file into sessions and returns how
+// many there are and the longest one. Of equally long sessions the first
+// wins, and ok is false when no session lasted any time at all.
+func (t *sessionTracker) longest() (count int, longest sessionSpan, ok bool) {
+	slices.SortFunc(t.spans, func(a, b sessionSpan) int {
+		return cmp.Compare(a.start, b.start)
+	})
+
+	var current sessionSpan
+
+	finish := func() {
+		if current.duration() > longest.duration() {
+			longest = current
+			ok = true
+		}
+	}
+
+	for i, span := range t.spans {
+		if i > 0 && span.start-current.end < sessionGap {
+			current.end = max(current.end, span.end)
+			continue
+		}
+
+		if i > 0 {
+			finish()
+		}
+
+		current = span
+		count++
+	}
+
+	if count > 0 {
+		finish()
+	}
+
+	return count, longest, ok
+}
+
+// sessionSummary is what the analysis reports about listening sessions:
+// how many there were, and when the longest was and what was played in it.
+type sessionSummary struct {
+	count   int
+	start   time.Time
+	end     time.Time
+	artists map[string]int
+	tracks  map[string]int
+}
+
+// summarize finds the longest session and reads the files it falls in
+// again to count what was played in it, since the plays themselves
+// weren't kept. The session is reported in loc, the user's zone.
+func (t *sessionTracker) summarize(ctx context.Context, policy PlayPolicy, loc *time.Location) (*sessionSummary, error) {
+	count, longest, ok := t.longest()
+
+	t.plays = nil
+
+	summary := &sessionSummary{
+		count:   count,
+		artists: make(map[string]int),
+		tracks:  make(map[string]int),
+	}
+
+	if !ok {
+		return summary, nil
+	}
+
+	summary.start = time.Unix(longest.start, 0).In(loc)
+	summary.end = time.Unix(longest.end, 0).In(loc)
+
+	for _, file := range t.files {
+		if file.end < longest.start || file.start > longest.end {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		_, err := decodeHistoryFile(file.file, func(track Track) error {
+			if !policy.Qualifies(track) {
+				return nil
+			}
+
+			timestamp, err := time.Parse(timestampLayout, track.Ts)
+			if err != nil {
+				return nil
+			}
+
+			if at := timestamp.Unix(); at >= longest.start && at <= longest.end {
+				summary.artists[track.MasterMetadataAlbumArtistName]++
+				summary.tracks[track.MasterMetadataTrackName]++
+			}
+
+			return nil
+		})
+
+		// The first read already logged a malformed file, and stopped at
+		// the same place.
+		if err != nil && !isMalformedJSON(err) {
+			return nil, err
+		}
+	}
+
+	return summary, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Spotify splits extended histories into files of roughly this many entries.
+const benchEntriesPerFile = 100_000
+
+// writeLargeTestExport writes an export of entries entries spread over
+// several history files, encoding one entry at a time so the generator
+// itself stays small.
+func writeLargeTestExport(tb testing.TB, path string, entries int) {
+	tb.Helper()
+
+	file, err := os.Create(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer file.Close()
+
+	archive := zip.NewWriter(file)
+
+	for start := 0; start < entries; start += benchEntriesPerFile {
+		name := fmt.Sprintf("%s/Streaming_History_Audio_%d.json", SPOTIFY_FOLDER_NAME, start/benchEntriesPerFile)
+
+		entry, err := archive.Create(name)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		w := bufio.NewWriter(entry)
+		encoder := json.NewEncoder(w)
+
+		w.WriteString("[")
+		for i := start; i < min(start+benchEntriesPerFile, entries); i++ {
+			if i > start {
+				w.WriteString(",")
+			}
+			if err := encoder.Encode(testTrack(i)); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		w.WriteString("]")
+
+		if err := w.Flush(); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// peakHeap samples the live heap until stop is called and returns the
+// highest value it saw.
+func peakHeap() (stop func() uint64) {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+
+	var peak uint64
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	read := func() {
+		metrics.Read(sample)
+		peak = max(peak, sample[0].Value.Uint64())
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				read()
+			}
+		}
+	}()
+
+	return func() uint64 {
+		close(done)
+		wg.Wait()
+		read()
+		return peak
+	}
+}
+
+// BenchmarkParseListeningHistory2M parses a synthetic 2M entry export and
+// reports the peak live heap alongside the allocations. The synthetic
+// history is one unbroken session, so every file is read a second time to
+// summarize it, which is the worst case for time and allocations:
+//
+//	go test -run '^$' -bench ParseListeningHistory2M -benchtime 1x
+func BenchmarkParseListeningHistory2M(b *testing.B) {
+	const entries = 2_000_000
+
+	path := filepath.Join(b.TempDir(), "export.zip")
+	writeLargeTestExport(b, path, entries)
+
+	// The synthetic export compresses far better than a real one, so only
+	// the job budget applies.
+	archive, err := ExtractAndFindAudioHistoryFiles(context.Background(), path, ArchiveLimits{}, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer archive.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var peak uint64
+
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+		stop := peakHeap()
+
+		history, err := ParseListeningHistoryFiles(context.Background(), archive.Files, AnalysisOptions{}, NewJobBudget(DefaultJobLimits()))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		peak = max(peak, stop())
+
+		if history.totals.entries != entries {
+			b.Fatalf("parsed %d entries, want %d", history.totals.entries, entries)
+		}
+	}
+
+	b.ReportMetric(float64(peak), "peak-heap-bytes")
+}
+
+// TestParseMemoryIsBounded parses exports of two sizes and checks that
+// neither what is kept after parsing nor the peak heap while parsing grows
+// with the number of entries. Keeping even 16 bytes per entry would retain
+// over 6MB of the larger one.
+func TestParseMemoryIsBounded(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes a large export")
+	}
+
+	const maxRetained = 1 << 20
+
+	var peaks []uint64
+
+	for _, entries := range []int{100_000, 400_000} {
+		path := filepath.Join(t.TempDir(), "export.zip")
+		writeLargeTestExport(t, path, entries)
+
+		archive, err := ExtractAndFindAudioHistoryFiles(context.Background(), path, ArchiveLimits{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		stop := peakHeap()
+
+		history, err := ParseListeningHistoryFiles(context.Background(), archive.Files, AnalysisOptions{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		peak := stop()
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		runtime.KeepAlive(history)
+		archive.Close()
+
+		retained := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+		t.Logf("%d entries: peak heap %d bytes, %d bytes retained", entries, peak, retained)
+
+		if retained > maxRetained {
+			t.Errorf("%d entries retained %d bytes after parsing, want at most %d", entries, retained, maxRetained)
+		}
+
+		peaks = append(peaks, peak)
+	}
+
+	if peaks[1] > 2*peaks[0] {
+		t.Errorf("peak heap went from %d to %d bytes with four times the entries", peaks[0], peaks[1])
+	}
+}
+
+func TestSessionsAreMergedAcrossFiles(t *testing.T) {
+	at := func(minutes int) time.Time {
+		return time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(minutes) * time.Minute)
+	}
+
+	var tracker sessionTracker
+
+	// Two files whose plays interleave: on their own each is cut into
+	// short sessions, together they are one session from 0 to 200.
+	for _, minutes := range []int{0, 80, 160, 400} {
+		tracker.add(at(minutes))
+	}
+	tracker.endFile(nil)
+
+	for _, minutes := range []int{200, 120, 40, 500} {
+		tracker.add(at(minutes))
+	}
+	tracker.endFile(nil)
+
+	count, longest, ok := tracker.longest()
+	if !ok || count != 3 {
+		t.Fatalf("found %d sessions (ok %v), want 3", count, ok)
+	}
+	if longest.start != at(0).Unix() || longest.end != at(200).Unix() {
+		t.Fatalf("longest session = %s to %s, want %s to %s",
+			time.Unix(longest.start, 0).UTC(), time.Unix(longest.end, 0).UTC(), at(0), at(200))
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"sort"
+)
+
+// ContentKind is what a history entry was a play of.
+type ContentKind string
+
+const (
+	ContentMusic     ContentKind = "music"
+	ContentPodcast   ContentKind = "podcast"
+	ContentAudiobook ContentKind = "audiobook"
+)
+
+// Kind tells music apart from podcast episodes and audiobook chapters. Music
+// is the default so entries with no metadata at all are counted as they
+// always were.
+func (t Track) Kind() ContentKind {
+	switch {
+	case t.EpisodeName != "" || t.EpisodeShowName != "" || t.SpotifyEpisodeUri != "":
+		return ContentPodcast
+	case t.AudiobookTitle != "" || t.AudiobookUri != "" || t.AudiobookChapterUri != "":
+		return ContentAudiobook
+	default:
+		return ContentMusic
+	}
+}
+
+// ShowData has no URI of its own in the export, so it carries the URI of an
+// episode from the show, the same way ArtistData carries a track's.
+type ShowData struct {
+	Count      int    `json:"count"`
+	Ms         int    `json:"ms"`
+	Show       string `json:"show"`
+	EpisodeUri string `json:"episode_uri"`
+}
+
+type EpisodeData struct {
+	Count   int    `json:"count"`
+	Ms      int    `json:"ms"`
+	Episode string `json:"episode"`
+	Show    string `json:"show"`
+	Uri     string `json:"uri"`
+}
+
+type AudiobookData struct {
+	Count int    `json:"count"`
+	Ms    int    `json:"ms"`
+	Title string `json:"title"`
+	Uri   string `json:"uri"`
+}
+
+// PodcastAnalysis covers everything that isn't music: podcast episodes,
+// including video podcasts, and audiobooks. Shares are fractions of all
+// listening time.
+type PodcastAnalysis struct {
+	TopShows             []ShowData      `json:"top_shows"`
+	TopEpisodes          []EpisodeData   `json:"top_episodes"`
+	TopAudiobooks        []AudiobookData `json:"top_audiobooks"`
+	PodcastMs            int             `json:"podcast_ms"`
+	AudiobookMs          int             `json:"audiobook_ms"`
+	MusicMs              int             `json:"music_ms"`
+	PodcastShare         float64         `json:"podcast_share"`
+	AudiobookShare       float64         `json:"audiobook_share"`
+	MusicShare           float64         `json:"music_share"`
+	PodcastListeningTime ListeningTime   `json:"podcast_listening_time"`
+}
+
+// spokenAggregation is the podcast and audiobook side of an aggregation.
+type spokenAggregation struct {
+	musicMs     int
+	podcastMs   int
+	audiobookMs int
+
+	shows      map[string]ShowData
+	episodes   map[string]EpisodeData
+	audiobooks map[string]AudiobookData
+}
+
+func newSpokenAggregation() spokenAggregation {
+	return spokenAggregation{
+		shows:      make(map[string]ShowData),
+		episodes:   make(map[string]EpisodeData),
+		audiobooks: make(map[string]AudiobookData),
+	}
+}
+
+// add records a podcast or audiobook play, returning false for music.
+func (s *spokenAggregation) add(track Track) bool {
+	switch track.Kind() {
+	case ContentPodcast:
+		s.podcastMs += track.MsPlayed
+
+		showName := track.EpisodeShowName
+		showData := s.shows[showName]
+		showData.Count++
+		showData.Ms += track.MsPlayed
+		showData.Show = showName
+		showData.EpisodeUri = track.SpotifyEpisodeUri
+		s.shows[showName] = showData
+
+		// The basic export has no episode URIs, and episode names are only
+		// unique within a show.
+		episodeKey := track.SpotifyEpisodeUri
+		if episodeKey == "" {
+			episodeKey = showName + "\x00" + track.EpisodeName
+		}
+
+		episodeData := s.episodes[episodeKey]
+		episodeData.Count++
+		episodeData.Ms += track.MsPlayed
+		episodeData.Episode = track.EpisodeName
+		episodeData.Show = showName
+		episodeData.Uri = track.SpotifyEpisodeUri
+		s.episodes[episodeKey] = episodeData
+
+		return true
+
+	case ContentAudiobook:
+		s.audiobookMs += track.MsPlayed
+
+		bookKey := track.AudiobookUri
+		if bookKey == "" {
+			bookKey = track.AudiobookTitle
+		}
+
+		bookData := s.audiobooks[bookKey]
+		bookData.Count++
+		bookData.Ms += track.MsPlayed
+		bookData.Title = track.AudiobookTitle
+		bookData.Uri = track.AudiobookUri
+		s.audiobooks[bookKey] = bookData
+
+		return true
+	}
+
+	s.musicMs += track.MsPlayed
+
+	return false
+}
+
+func (s *spokenAggregation) merge(other *spokenAggregation) {
+	s.musicMs += other.musicMs
+	s.podcastMs += other.podcastMs
+	s.audiobookMs += other.audiobookMs
+
+	for showName, data := range other.shows {
+		globalData := s.shows[showName]
+		globalData.Count += data.Count
+		globalData.Ms += data.Ms
+		globalData.Show = data.Show
+		globalData.EpisodeUri = data.EpisodeUri
+		s.shows[showName] = globalData
+	}
+
+	for episodeKey, data := range other.episodes {
+		globalData := s.episodes[episodeKey]
+		globalData.Count += data.Count
+		globalData.Ms += data.Ms
+		globalData.Episode = data.Episode
+		globalData.Show = data.Show
+		globalData.Uri = data.Uri
+		s.episodes[episodeKey] = globalData
+	}
+
+	for bookKey, data := range other.audiobooks {
+		globalData := s.audiobooks[bookKey]
+		globalData.Count += data.Count
+		globalData.Ms += data.Ms
+		globalData.Title = data.Title
+		globalData.Uri = data.Uri
+		s.audiobooks[bookKey] = globalData
+	}
+}
+
+func getPodcastAnalysis(spoken *spokenAggregation) PodcastAnalysis {
+	shows := make([]ShowData, 0, len(spoken.shows))
+	for name, data := range spoken.shows {
+		if name != "" {
+			shows = append(shows, data)
+		}
+	}
+
+	episodes := make([]EpisodeData, 0, len(spoken.episodes))
+	for _, data := range spoken.episodes {
+		if data.Episode != "" {
+			episodes = append(episodes, data)
+		}
+	}
+
+	audiobooks := make([]AudiobookData, 0, len(spoken.audiobooks))
+	for _, data := range spoken.audiobooks {
+		if data.Title != "" {
+			audiobooks = append(audiobooks, data)
+		}
+	}
+
+	sort.Slice(shows, func(i, j int) bool {
+		return shows[i].Ms > shows[j].Ms
+	})
+
+	sort.Slice(episodes, func(i, j int) bool {
+		return episodes[i].Ms > episodes[j].Ms
+	})
+
+	sort.Slice(audiobooks, func(i, j int) bool {
+		return audiobooks[i].Ms > audiobooks[j].Ms
+	})
+
+	totalMs := spoken.musicMs + spoken.podcastMs + spoken.audiobookMs
+
+	share := func(ms int) float64 {
+		if totalMs == 0 {
+			return 0
+		}
+		return float64(ms) / float64(totalMs)
+	}
+
+	return PodcastAnalysis{
+		TopShows:       shows[:min(25, len(shows))],
+		TopEpisodes:    episodes[:min(25, len(episodes))],
+		TopAudiobooks:  audiobooks[:min(10, len(audiobooks))],
+		PodcastMs:      spoken.podcastMs,
+		AudiobookMs:    spoken.audiobookMs,
+		MusicMs:        spoken.musicMs,
+		PodcastShare:   share(spoken.podcastMs),
+		AudiobookShare: share(spoken.audiobookMs),
+		MusicShare:     share(spoken.musicMs),
+		PodcastListeningTime: ListeningTime{
+			Hours:   spoken.podcastMs / (1000 * 60 * 60),
+			Minutes: (spoken.podcastMs % (1000 * 60 * 60)) / (1000 * 60),
+		},
+	}
+}
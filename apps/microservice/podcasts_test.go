@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrackKind(t *testing.T) {
+	tests := []struct {
+		track Track
+		want  ContentKind
+	}{
+		{Track{MasterMetadataTrackName: "Song"}, ContentMusic},
+		{Track{}, ContentMusic},
+		{Track{EpisodeName: "Episode 1", EpisodeShowName: "Show"}, ContentPodcast},
+		{Track{SpotifyEpisodeUri: "spotify:episode:1"}, ContentPodcast},
+		{Track{AudiobookTitle: "Book", AudiobookChapterUri: "spotify:chapter:1"}, ContentAudiobook},
+	}
+
+	for _, tt := range tests {
+		if got := tt.track.Kind(); got != tt.want {
+			t.Errorf("Kind(%+v) = %q, want %q", tt.track, got, tt.want)
+		}
+	}
+}
+
+func episode(at time.Time, show, name, uri string, ms int) Track {
+	return Track{
+		Ts:                at.Format(timestampLayout),
+		Platform:          "ios",
+		MsPlayed:          ms,
+		ConnCountry:       "DE",
+		EpisodeName:       name,
+		EpisodeShowName:   show,
+		SpotifyEpisodeUri: uri,
+		ReasonEnd:         "trackdone",
+	}
+}
+
+func TestPodcastTotalsAreKeptApartFromMusic(t *testing.T) {
+	start := time.Date(2023, 1, 6, 12, 0, 0, 0, time.UTC)
+	at := func(i int) time.Time {
+		return start.Add(time.Duration(i) * 4 * time.Minute)
+	}
+
+	tests := []struct {
+		name          string
+		tracks        []Track
+		wantMusicMs   int
+		wantPodcastMs int
+		wantShows     int
+		wantEpisodes  int
+		wantMusic     int
+	}{
+		{
+			"music only",
+			[]Track{
+				play(at(0), "Artist A", "Song", "Album", "spotify:track:1"),
+				play(at(1), "Artist A", "Song", "Album", "spotify:track:1"),
+			},
+			2 * 180_000, 0, 0, 0, 2,
+		},
+		{
+			"podcasts only",
+			[]Track{
+				episode(at(0), "Show", "Episode 1", "spotify:episode:1", 600_000),
+				episode(at(1), "Show", "Episode 2", "spotify:episode:2", 600_000),
+			},
+			0, 2 * 600_000, 1, 2, 0,
+		},
+		{
+			"mixed",
+			[]Track{
+				play(at(0), "Artist A", "Song", "Album", "spotify:track:1"),
+				episode(at(1), "Show", "Episode 1", "spotify:episode:1", 600_000),
+				episode(at(2), "Show", "Episode 1", "spotify:episode:1", 300_000),
+				episode(at(3), "Other Show", "Episode 1", "spotify:episode:3", 600_000),
+				play(at(4), "Artist B", "Other Song", "Album", "spotify:track:2"),
+			},
+			2 * 180_000, 1_500_000, 2, 2, 2,
+		},
+	}
+
+	for _, tt := range tests {
+		result := analyzeTracks(t, tt.tracks, AnalysisOptions{})
+		podcasts := result.Podcasts
+
+		if podcasts.MusicMs != tt.wantMusicMs || podcasts.PodcastMs != tt.wantPodcastMs {
+			t.Errorf("%s: music %d ms, podcasts %d ms, want %d and %d",
+				tt.name, podcasts.MusicMs, podcasts.PodcastMs, tt.wantMusicMs, tt.wantPodcastMs)
+		}
+		if len(podcasts.TopShows) != tt.wantShows || len(podcasts.TopEpisodes) != tt.wantEpisodes {
+			t.Errorf("%s: %d shows and %d episodes, want %d and %d",
+				tt.name, len(podcasts.TopShows), len(podcasts.TopEpisodes), tt.wantShows, tt.wantEpisodes)
+		}
+
+		total := float64(tt.wantMusicMs + tt.wantPodcastMs)
+		if podcasts.MusicShare != float64(tt.wantMusicMs)/total || podcasts.PodcastShare != float64(tt.wantPodcastMs)/total {
+			t.Errorf("%s: shares = music %v, podcasts %v", tt.name, podcasts.MusicShare, podcasts.PodcastShare)
+		}
+
+		music := 0
+		for _, track := range result.TopTracks {
+			music += track.Count
+			if track.Track == "" {
+				t.Errorf("%s: top tracks = %+v, want no episodes among them", tt.name, result.TopTracks)
+			}
+		}
+		if music != tt.wantMusic {
+			t.Errorf("%s: %d plays in the top tracks, want %d", tt.name, music, tt.wantMusic)
+		}
+	}
+}
@@ -1,11 +1,9 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
-	"os"
-	"runtime"
 	"sort"
 	"sync"
 	"time"
@@ -22,8 +20,15 @@ type Track struct {
 	SpotifyTrackUri               string `json:"spotify_track_uri"`
 	ReasonStart                   string `json:"reason_start"`
 	ReasonEnd                     string `json:"reason_end"`
-	Shuffle                       bool   `json:"shuffle"`
+	Shuffle                       *bool  `json:"shuffle"`
 	Skipped                       bool   `json:"skipped"`
+	EpisodeName                   string `json:"episode_name"`
+	EpisodeShowName               string `json:"episode_show_name"`
+	SpotifyEpisodeUri             string `json:"spotify_episode_uri"`
+	AudiobookTitle                string `json:"audiobook_title"`
+	AudiobookUri                  string `json:"audiobook_uri"`
+	AudiobookChapterUri           string `json:"audiobook_chapter_uri"`
+	AudiobookChapterTitle         string `json:"audiobook_chapter_title"`
 }
 
 type SimplifiedTrack struct {
@@ -34,16 +39,18 @@ type SimplifiedTrack struct {
 }
 
 type ArtistData struct {
-	Count  int    `json:"count"`
-	Artist string `json:"artist"`
-	Uri    string `json:"uri"`
+	Count    int    `json:"count"`
+	RawCount int    `json:"raw_count"`
+	Artist   string `json:"artist"`
+	Uri      string `json:"uri"`
 }
 
 type TrackData struct {
-	Count  int    `json:"count"`
-	Track  string `json:"track"`
-	Uri    string `json:"uri"`
-	Artist string `json:"artist"`
+	Count    int    `json:"count"`
+	RawCount int    `json:"raw_count"`
+	Track    string `json:"track"`
+	Uri      string `json:"uri"`
+	Artist   string `json:"artist"`
 }
 
 type ListeningInsight struct {
@@ -95,7 +102,9 @@ type ArtistMinutes struct {
 
 type AlbumPlays struct {
 	Name     string `json:"name"`
+	Artist   string `json:"artist"`
 	Count    int    `json:"count"`
+	RawCount int    `json:"raw_count"`
 	TrackURI string `json:"track_uri"`
 }
 
@@ -110,6 +119,7 @@ type AggregatedData struct {
 
 type ProcessResult struct {
 	ProcessID       string                 `json:"processId"`
+	Format          HistoryFormat          `json:"format"`
 	TotalMs         int                    `json:"totalMs"`
 	TopArtists      []ArtistData           `json:"topArtists"`
 	TopTracks       []TrackData            `json:"topTracks"`
@@ -117,6 +127,9 @@ type ProcessResult struct {
 	UniqueArtists   int                    `json:"uniqueArtists"`
 	UniqueTracks    int                    `json:"uniqueTracks"`
 	TotalTracks     int                    `json:"totalTracks"`
+	RawTotalTracks  int                    `json:"rawTotalTracks"`
+	PlayPolicy      PlayPolicy             `json:"playPolicy"`
+	Timezone        string                 `json:"timezone"`
 	ListeningTime   ListeningTime          `json:"listeningTime"`
 	PeakHour        int                    `json:"peakHour"`
 	TimesOfDay      []TimesOfDay           `json:"times_of_day"`
@@ -125,87 +138,35 @@ type ProcessResult struct {
 	WeekdayAnalysis WeekdayAnalysis        `json:"weekday_analysis"`
 	LongestSession  map[string]interface{} `json:"longest_session"`
 	AggregatedData  AggregatedData         `json:"aggregated_data"`
+	Podcasts        PodcastAnalysis        `json:"podcasts"`
+	Skips           SkipAnalysis           `json:"skips"`
+	Shuffle         ShuffleAnalysis        `json:"shuffle"`
 }
 
-func ProcessListeningHistoryFiles(jsonFilePaths []string, processId string) (*ProcessResult, error) {
-	fmt.Println("Starting Parse")
-
-	var allEntries []Track
-
-	for _, jsonFilePath := range jsonFilePaths {
-		fmt.Printf("Processing JSON file: %s", jsonFilePath)
-
-		data, err := os.ReadFile(jsonFilePath)
-		if err != nil {
-			return nil, fmt.Errorf("error reading file: %w", err)
-		}
-
-		// Check for UTF-8 BOM and skip if present
-		if len(data) >= 3 && data[0] == 0xEF && data[1] == 0xBB && data[2] == 0xBF {
-			data = data[3:]
-		}
-
-		var entries []Track
-		err = json.Unmarshal(data, &entries)
-		if err != nil {
-			log.Printf("Error parsing JSON in %s: %v", jsonFilePath, err)
-			continue
-		}
-
-		log.Printf("Found %d tracks in file %s", len(entries), jsonFilePath)
-		allEntries = append(allEntries, entries...)
-	}
-
-	if len(allEntries) == 0 {
-		return nil, fmt.Errorf("no valid entries found in any of the JSON files")
+func ProcessListeningHistoryFiles(ctx context.Context, historyFiles []*HistoryFile, processId string, options AnalysisOptions, budget *JobBudget) (*ProcessResult, error) {
+	history, err := ParseListeningHistoryFiles(ctx, historyFiles, options, budget)
+	if err != nil {
+		return nil, err
 	}
 
-	log.Printf("Processing a total of %d tracks from all files", len(allEntries))
-
-	var wg sync.WaitGroup
-	var mutex sync.Mutex
-
-	availableWorkers := runtime.NumCPU()
-	chunkSize := len(allEntries) / availableWorkers
-
-	totalMs := 0
-
-	artists := make(map[string]*ArtistData)
-	tracks := make(map[string]*TrackData)
-
-	timeOfDayMap := make(map[int]int)
-	countryCodes := make(map[string]int)
-	platforms := make(map[string]int)
-
-	artistsPlaysMap := make(map[string]ArtistData)
-	artistsMinutesMap := make(map[string]ArtistMinutes)
-	albumPlaysMap := make(map[string]AlbumPlays)
-	trackPlaysMap := make(map[string]TrackData)
-
-	simplifiedTracks := make([]SimplifiedTrack, 0, len(allEntries))
-
-	for i := 0; i < availableWorkers; i++ {
-		start := i * chunkSize
-		end := (i + 1) * chunkSize
+	return AnalyzeListeningHistory(ctx, history, processId)
+}
 
-		if i == availableWorkers-1 {
-			end = len(allEntries)
-		}
+func AnalyzeListeningHistory(ctx context.Context, history *ListeningHistory, processId string) (*ProcessResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-		wg.Add(1)
+	totals := history.totals
 
-		go worker(allEntries[start:end], &wg, &mutex, &totalMs, &timeOfDayMap, &simplifiedTracks, &artists,
-			&tracks,
-			&countryCodes,
-			&platforms,
-			&artistsPlaysMap,
-			&artistsMinutesMap,
-			&albumPlaysMap,
-			&trackPlaysMap,
-		)
-	}
+	totalMs := totals.totalMs
+	timeOfDayMap := totals.timeOfDay
+	countryCodes := totals.countryCodes
 
-	wg.Wait()
+	artistsPlaysMap := totals.artistsPlays
+	artistsMinutesMap := totals.artistsMinutes
+	albumPlaysMap := totals.albumPlays
+	trackPlaysMap := totals.trackPlays
 
 	// Find peak listening hour
 	peakHour := 0
@@ -260,10 +221,12 @@ func ProcessListeningHistoryFiles(jsonFilePaths []string, processId string) (*Pr
 
 	log.Printf("Generated time message: '%s'", timeMessage)
 
-	topArtists := getTopArtists(artists, 25)
-	topTracks := getTopTracks(tracks, 50)
+	totals.resolveTrackUris()
 
-	listening_stats := calculateListeningStats(simplifiedTracks, totalMs)
+	topArtists := getTopArtists(totals.artists, 25)
+	topTracks := getTopTracks(totals.tracks, 50)
+
+	listening_stats := calculateListeningStats(totals)
 
 	stats := listening_stats["total_listening_time"].(struct {
 		Minutes int
@@ -285,9 +248,9 @@ func ProcessListeningHistoryFiles(jsonFilePaths []string, processId string) (*Pr
 		travelerMessage = fmt.Sprintf("Your music has traveled %d countries with you!", len(countryCodes))
 	}
 
-	heatmapData := processHeatmapData(simplifiedTracks)
-	weekdayAnalysis := getWeekdayAnalysis(simplifiedTracks)
-	longestSession := getLongestSession(simplifiedTracks)
+	heatmapData := processHeatmapData(totals.dailyCounts)
+	weekdayAnalysis := getWeekdayAnalysis(totals.dailyCounts)
+	longestSession := getLongestSession(history.sessions)
 
 	artistPlays := make([]ArtistData, 0, len(artistsPlaysMap))
 	for _, v := range artistsPlaysMap {
@@ -335,6 +298,7 @@ func ProcessListeningHistoryFiles(jsonFilePaths []string, processId string) (*Pr
 
 	result := &ProcessResult{
 		ProcessID:       processId,
+		Format:          history.format(),
 		TotalMs:         totalMs,
 		TopArtists:      topArtists[:min(10, len(topArtists))],
 		TopTracks:       topTracks[:min(25, len(topTracks))],
@@ -343,6 +307,9 @@ func ProcessListeningHistoryFiles(jsonFilePaths []string, processId string) (*Pr
 		UniqueArtists:   listening_stats["unique_artists"].(int),
 		UniqueTracks:    listening_stats["unique_tracks"].(int),
 		TotalTracks:     listening_stats["total_tracks_played"].(int),
+		RawTotalTracks:  totals.rawPlayed,
+		PlayPolicy:      history.policy,
+		Timezone:        history.timezone,
 		TimesOfDay:      timesOfDay,
 		TravelerMessage: travelerMessage,
 		Heatmap:         heatmapData,
@@ -358,6 +325,9 @@ func ProcessListeningHistoryFiles(jsonFilePaths []string, processId string) (*Pr
 			AlbumPlays:    albumPlays,
 			TrackPlays:    trackPlays,
 		},
+		Podcasts: getPodcastAnalysis(&totals.spoken),
+		Skips:    getSkipAnalysis(&totals.skips, totals.trackUris),
+		Shuffle:  getShuffleAnalysis(&totals.shuffle),
 	}
 
 	return result, nil
@@ -375,48 +345,117 @@ func incrementMapValue(m map[string]int, key string) {
 	m[key]++
 }
 
-func worker(entries []Track, wg *sync.WaitGroup, mutex *sync.Mutex, totalMs *int, timeOfDay *map[int]int, simplifiedTracks *[]SimplifiedTrack, artists *map[string]*ArtistData, tracks *map[string]*TrackData, countryCodes, platforms *map[string]int,
-	artistsPlaysMap *map[string]ArtistData,
-	artistsMinutesMap *map[string]ArtistMinutes,
-	albumPlaysMap *map[string]AlbumPlays,
-	trackPlaysMap *map[string]TrackData) {
+// aggregation holds the running totals the analysis is built from. Each
+// worker fills its own and merges it into the shared one when it is done.
+type aggregation struct {
+	totalMs int
+	entries int
+
+	// Music entries with a timestamp we could parse. Only these count
+	// towards the play counts, and of those only the ones the play policy
+	// qualifies count towards played.
+	played    int
+	rawPlayed int
+	earliest  time.Time
+	latest    time.Time
+
+	artists      map[string]*ArtistData
+	tracks       map[string]*TrackData
+	timeOfDay    map[int]int
+	countryCodes map[string]int
+	platforms    map[string]int
+	dailyCounts  map[string]int
+
+	artistsPlays   map[string]ArtistData
+	artistsMinutes map[string]ArtistMinutes
+	albumPlays     map[string]AlbumPlays
+	trackPlays     map[string]TrackData
+
+	// Tracks, track plays and albums are keyed by trackKey and albumKey
+	// rather than by name. trackUris picks the URI to report for each.
+	trackUris uriCounts
+
+	spoken  spokenAggregation
+	skips   skipAggregation
+	shuffle shuffleAggregation
+}
 
+func newAggregation() *aggregation {
+	return &aggregation{
+		artists:        make(map[string]*ArtistData),
+		tracks:         make(map[string]*TrackData),
+		timeOfDay:      make(map[int]int),
+		countryCodes:   make(map[string]int),
+		platforms:      make(map[string]int),
+		dailyCounts:    make(map[string]int),
+		artistsPlays:   make(map[string]ArtistData),
+		artistsMinutes: make(map[string]ArtistMinutes),
+		albumPlays:     make(map[string]AlbumPlays),
+		trackPlays:     make(map[string]TrackData),
+		trackUris:      make(uriCounts),
+		spoken:         newSpokenAggregation(),
+		skips:          newSkipAggregation(),
+		shuffle:        newShuffleAggregation(),
+	}
+}
+
+func worker(batches <-chan []playEntry, wg *sync.WaitGroup, mutex *sync.Mutex, totals *aggregation) {
 	defer wg.Done()
 
-	localTotalMs := 0
-	localArtistsMap := make(map[string]*ArtistData)
-	localTracksMap := make(map[string]*TrackData)
-	localCountryCodes := make(map[string]int)
-	localTimeOfDayForTracksMap := make(map[int]int)
-	localPlatformMap := make(map[string]int)
+	local := newAggregation()
+
+	for batch := range batches {
+		for _, entry := range batch {
+			local.add(entry)
+		}
+	}
+
+	mutex.Lock()
+	totals.merge(local)
+	mutex.Unlock()
+}
+
+func (a *aggregation) add(entry playEntry) {
+	track := entry.Track
 
-	localArtistsPlaysMap := make(map[string]ArtistData)
-	localArtistsMinutesMap := make(map[string]ArtistMinutes)
-	localAlbumPlaysMap := make(map[string]AlbumPlays)
-	localTrackPlaysMap := make(map[string]TrackData)
+	a.entries++
+	a.totalMs += track.MsPlayed
+	trackName := track.MasterMetadataTrackName
+	trackKey := trackKey(track)
+	artistName := track.MasterMetadataAlbumArtistName
+	countryCode := track.ConnCountry
+	platform := track.Platform
 
-	localSimplifiedTracks := make([]SimplifiedTrack, 0, len(entries))
+	// Neither is in the basic export, so an empty one isn't a country or
+	// platform of its own.
+	if countryCode != "" {
+		incrementMapValue(a.countryCodes, countryCode)
+	}
+	if platform != "" {
+		incrementMapValue(a.platforms, platform)
+	}
 
-	for _, track := range entries {
-		localTotalMs += track.MsPlayed
-		trackName := track.MasterMetadataTrackName
-		artistName := track.MasterMetadataAlbumArtistName
-		countryCode := track.ConnCountry
-		platform := track.Platform
+	// Podcasts and audiobooks still count as listening time, but are kept
+	// out of the music stats.
+	spoken := a.spoken.add(track)
 
-		incrementMapValue(localCountryCodes, countryCode)
-		incrementMapValue(localPlatformMap, platform)
+	// Entries the play policy doesn't count still show up in the raw counts.
+	plays := 0
+	if entry.qualified {
+		plays = 1
+	}
 
-		if _, exists := localArtistsMap[artistName]; !exists {
-			localArtistsMap[artistName] = &ArtistData{
+	if !spoken {
+		if _, exists := a.artists[artistName]; !exists {
+			a.artists[artistName] = &ArtistData{
 				Count:  0,
 				Artist: artistName,
 				Uri:    track.SpotifyTrackUri,
 			}
 		}
 
-		if _, exists := localTracksMap[trackName]; !exists {
-			localTracksMap[trackName] = &TrackData{
+		if _, exists := a.tracks[trackKey]; !exists {
+			a.tracks[trackKey] = &TrackData{
 				Count:  0,
 				Track:  trackName,
 				Uri:    track.SpotifyTrackUri,
@@ -424,131 +463,188 @@ func worker(entries []Track, wg *sync.WaitGroup, mutex *sync.Mutex, totalMs *int
 			}
 		}
 
-		localArtistsMap[artistName].Count++
-		localTracksMap[trackName].Count++
+		a.artists[artistName].Count += plays
+		a.artists[artistName].RawCount++
+		a.tracks[trackKey].Count += plays
+		a.tracks[trackKey].RawCount++
+		a.tracks[trackKey].Track = displayTitle(a.tracks[trackKey].Track, trackName)
+		a.trackUris.add(trackKey, track.SpotifyTrackUri, 1)
+		a.skips.add(entry, trackKey)
+		a.shuffle.add(entry, albumKey(track))
+	}
 
-		dateString := track.Ts
-		layout := "2006-01-02T15:04:05Z"
+	if !entry.valid {
+		return
+	}
 
-		timestamp, err := time.Parse(layout, dateString)
-		if err != nil {
-			fmt.Println("Error parsing date:", err)
-			continue
-		}
+	timestamp := entry.at
 
-		hour := timestamp.Hour()
-		localTimeOfDayForTracksMap[hour]++
+	if a.earliest.IsZero() || timestamp.Before(a.earliest) {
+		a.earliest = timestamp
+	}
+	if timestamp.After(a.latest) {
+		a.latest = timestamp
+	}
 
-		simplifiedTrack := SimplifiedTrack{
-			Ts:        dateString,
-			Artist:    artistName,
-			Track:     trackName,
-			AlbumName: track.MasterMetadataAlbumAlbumName,
-		}
+	// The time based stats count plays, so they follow the policy too.
+	if entry.qualified {
+		a.timeOfDay[timestamp.Hour()]++
+		a.dailyCounts[timestamp.Format("2006-01-02")]++
+	}
+
+	if spoken {
+		return
+	}
 
-		localSimplifiedTracks = append(localSimplifiedTracks, simplifiedTrack)
+	a.played += plays
+	a.rawPlayed++
 
-		artistData := localArtistsPlaysMap[artistName]
-		artistData.Count++
-		artistData.Artist = artistName
-		artistData.Uri = track.SpotifyTrackUri
-		localArtistsPlaysMap[artistName] = artistData
+	artistData := a.artistsPlays[artistName]
+	artistData.Count += plays
+	artistData.RawCount++
+	artistData.Artist = artistName
+	artistData.Uri = track.SpotifyTrackUri
+	a.artistsPlays[artistName] = artistData
 
-		artistMinutes := localArtistsMinutesMap[artistName]
-		artistMinutes.Name = artistName
-		artistMinutes.Ms += track.MsPlayed
-		artistMinutes.Uri = track.SpotifyTrackUri
-		localArtistsMinutesMap[artistName] = artistMinutes
+	artistMinutes := a.artistsMinutes[artistName]
+	artistMinutes.Name = artistName
+	artistMinutes.Ms += track.MsPlayed
+	artistMinutes.Uri = track.SpotifyTrackUri
+	a.artistsMinutes[artistName] = artistMinutes
 
-		albumName := track.MasterMetadataAlbumAlbumName
-		albumData := localAlbumPlaysMap[albumName]
-		albumData.Name = albumName
-		albumData.Count++
+	// The basic export has no albums.
+	if albumKey := albumKey(track); albumKey != "" {
+		albumData := a.albumPlays[albumKey]
+		albumData.Name = displayTitle(albumData.Name, track.MasterMetadataAlbumAlbumName)
+		albumData.Artist = artistName
+		albumData.Count += plays
+		albumData.RawCount++
 		albumData.TrackURI = track.SpotifyTrackUri
-		localAlbumPlaysMap[albumName] = albumData
+		a.albumPlays[albumKey] = albumData
+	}
 
-		trackData := localTrackPlaysMap[trackName]
-		trackData.Count++
-		trackData.Track = trackName
-		trackData.Uri = track.SpotifyTrackUri
-		trackData.Artist = artistName
-		localTrackPlaysMap[trackName] = trackData
+	trackData := a.trackPlays[trackKey]
+	trackData.Count += plays
+	trackData.RawCount++
+	trackData.Track = displayTitle(trackData.Track, trackName)
+	trackData.Uri = track.SpotifyTrackUri
+	trackData.Artist = artistName
+	a.trackPlays[trackKey] = trackData
+}
+
+// resolveTrackUris reports every track with the URI it was played under most.
+func (a *aggregation) resolveTrackUris() {
+	for key, data := range a.tracks {
+		if uri := a.trackUris.preferred(key); uri != "" {
+			data.Uri = uri
+		}
 	}
 
-	mutex.Lock()
-	*totalMs += localTotalMs
+	for key, data := range a.trackPlays {
+		if uri := a.trackUris.preferred(key); uri != "" {
+			data.Uri = uri
+			a.trackPlays[key] = data
+		}
+	}
+}
 
-	for time, count := range localTimeOfDayForTracksMap {
-		(*timeOfDay)[time] += count
+func (a *aggregation) merge(other *aggregation) {
+	a.totalMs += other.totalMs
+	a.entries += other.entries
+	a.played += other.played
+	a.rawPlayed += other.rawPlayed
+
+	a.spoken.merge(&other.spoken)
+	a.skips.merge(&other.skips)
+	a.shuffle.merge(&other.shuffle)
+
+	if !other.earliest.IsZero() && (a.earliest.IsZero() || other.earliest.Before(a.earliest)) {
+		a.earliest = other.earliest
+	}
+	if other.latest.After(a.latest) {
+		a.latest = other.latest
+	}
+
+	for time, count := range other.timeOfDay {
+		a.timeOfDay[time] += count
+	}
+
+	for date, count := range other.dailyCounts {
+		a.dailyCounts[date] += count
 	}
 
-	for artist, data := range localArtistsMap {
-		if _, exists := (*artists)[artist]; !exists {
-			(*artists)[artist] = &ArtistData{
+	for artist, data := range other.artists {
+		if _, exists := a.artists[artist]; !exists {
+			a.artists[artist] = &ArtistData{
 				Count:  0,
 				Artist: artist,
 				Uri:    data.Uri,
 			}
 		}
-		(*artists)[artist].Count += data.Count
+		a.artists[artist].Count += data.Count
+		a.artists[artist].RawCount += data.RawCount
 	}
 
-	for track, data := range localTracksMap {
-		if _, exists := (*tracks)[track]; !exists {
-			(*tracks)[track] = &TrackData{
+	for key, data := range other.tracks {
+		if _, exists := a.tracks[key]; !exists {
+			a.tracks[key] = &TrackData{
 				Count:  0,
-				Track:  track,
+				Track:  data.Track,
 				Uri:    data.Uri,
 				Artist: data.Artist,
 			}
 		}
-		(*tracks)[track].Count += data.Count
+		a.tracks[key].Count += data.Count
+		a.tracks[key].RawCount += data.RawCount
+		a.tracks[key].Track = displayTitle(a.tracks[key].Track, data.Track)
 	}
 
-	for countryCode, count := range localCountryCodes {
-		(*countryCodes)[countryCode] += count
-	}
+	a.trackUris.merge(other.trackUris)
 
-	for platform, count := range localPlatformMap {
-		(*platforms)[platform] += count
+	for countryCode, count := range other.countryCodes {
+		a.countryCodes[countryCode] += count
 	}
 
-	*simplifiedTracks = append(*simplifiedTracks, localSimplifiedTracks...)
+	for platform, count := range other.platforms {
+		a.platforms[platform] += count
+	}
 
-	for artistName, data := range localArtistsPlaysMap {
-		globalData := (*artistsPlaysMap)[artistName]
+	for artistName, data := range other.artistsPlays {
+		globalData := a.artistsPlays[artistName]
 		globalData.Count += data.Count
+		globalData.RawCount += data.RawCount
 		globalData.Artist = data.Artist
 		globalData.Uri = data.Uri
-		(*artistsPlaysMap)[artistName] = globalData
+		a.artistsPlays[artistName] = globalData
 	}
 
-	for artistName, data := range localArtistsMinutesMap {
-		globalData := (*artistsMinutesMap)[artistName]
+	for artistName, data := range other.artistsMinutes {
+		globalData := a.artistsMinutes[artistName]
 		globalData.Name = data.Name
 		globalData.Ms += data.Ms
 		globalData.Uri = data.Uri
-		(*artistsMinutesMap)[artistName] = globalData
+		a.artistsMinutes[artistName] = globalData
 	}
 
-	for albumName, data := range localAlbumPlaysMap {
-		globalData := (*albumPlaysMap)[albumName]
-		globalData.Name = data.Name
+	for albumKey, data := range other.albumPlays {
+		globalData := a.albumPlays[albumKey]
+		globalData.Name = displayTitle(globalData.Name, data.Name)
+		globalData.Artist = data.Artist
 		globalData.Count += data.Count
+		globalData.RawCount += data.RawCount
 		globalData.TrackURI = data.TrackURI
-		(*albumPlaysMap)[albumName] = globalData
+		a.albumPlays[albumKey] = globalData
 	}
 
-	for trackName, data := range localTrackPlaysMap {
-		globalData := (*trackPlaysMap)[trackName]
+	for trackKey, data := range other.trackPlays {
+		globalData := a.trackPlays[trackKey]
 		globalData.Count += data.Count
-		globalData.Track = data.Track
+		globalData.RawCount += data.RawCount
+		globalData.Track = displayTitle(globalData.Track, data.Track)
 		globalData.Uri = data.Uri
 		globalData.Artist = data.Artist
-		(*trackPlaysMap)[trackName] = globalData
+		a.trackPlays[trackKey] = globalData
 	}
-
-	mutex.Unlock()
 }
 
 func getTopArtists(artists map[string]*ArtistData, limit int) []ArtistData {
@@ -559,9 +655,10 @@ func getTopArtists(artists map[string]*ArtistData, limit int) []ArtistData {
 			continue
 		}
 		artistsSlice = append(artistsSlice, ArtistData{
-			Artist: name,
-			Count:  data.Count,
-			Uri:    data.Uri,
+			Artist:   name,
+			Count:    data.Count,
+			RawCount: data.RawCount,
+			Uri:      data.Uri,
 		})
 	}
 
@@ -579,16 +676,17 @@ func getTopArtists(artists map[string]*ArtistData, limit int) []ArtistData {
 func getTopTracks(tracks map[string]*TrackData, limit int) []TrackData {
 	tracksSlice := make([]TrackData, 0, len(tracks))
 
-	for name, data := range tracks {
-		if name == "" {
+	for _, data := range tracks {
+		if data.Track == "" {
 			continue
 		}
 
 		tracksSlice = append(tracksSlice, TrackData{
-			Track:  name,
-			Count:  data.Count,
-			Uri:    data.Uri,
-			Artist: data.Artist,
+			Track:    data.Track,
+			Count:    data.Count,
+			RawCount: data.RawCount,
+			Uri:      data.Uri,
+			Artist:   data.Artist,
 		})
 	}
 
@@ -603,46 +701,28 @@ func getTopTracks(tracks map[string]*TrackData, limit int) []TrackData {
 	return tracksSlice
 }
 
-func calculateListeningStats(simplifiedTracks []SimplifiedTrack, totalMs int) map[string]interface{} {
+func calculateListeningStats(totals *aggregation) map[string]interface{} {
+	totalMs := totals.totalMs
+
 	hours := totalMs / (1000 * 60 * 60)
 	minutes := (totalMs % (1000 * 60 * 60)) / (1000 * 60)
 
-	artists := make(map[string]bool)
-	tracks := make(map[string]bool)
-
-	for _, track := range simplifiedTracks {
-		if track.Artist != "" {
-			artists[track.Artist] = true
-		}
-		if track.Track != "" {
-			tracks[track.Track] = true
+	uniqueArtists := 0
+	for artist, data := range totals.artistsPlays {
+		if artist != "" && data.Count > 0 {
+			uniqueArtists++
 		}
 	}
 
-	var earliestTimestamp, latestTimestamp time.Time
-	firstRun := true
-
-	layout := "2006-01-02T15:04:05Z"
-	for _, track := range simplifiedTracks {
-		timestamp, err := time.Parse(layout, track.Ts)
-		if err != nil {
-			continue
-		}
-
-		if firstRun {
-			earliestTimestamp = timestamp
-			latestTimestamp = timestamp
-			firstRun = false
-		} else {
-			if timestamp.Before(earliestTimestamp) {
-				earliestTimestamp = timestamp
-			}
-			if timestamp.After(latestTimestamp) {
-				latestTimestamp = timestamp
-			}
+	uniqueTracks := 0
+	for _, data := range totals.trackPlays {
+		if data.Track != "" && data.Count > 0 {
+			uniqueTracks++
 		}
 	}
 
+	earliestTimestamp, latestTimestamp := totals.earliest, totals.latest
+
 	dateRange := latestTimestamp.Sub(earliestTimestamp)
 	daysInRange := int(dateRange.Hours() / 24)
 
@@ -659,9 +739,9 @@ func calculateListeningStats(simplifiedTracks []SimplifiedTrack, totalMs int) ma
 			Minutes: minutes,
 			Hours:   hours,
 		},
-		"unique_tracks":       len(tracks),
-		"unique_artists":      len(artists),
-		"total_tracks_played": len(simplifiedTracks),
+		"unique_tracks":       uniqueTracks,
+		"unique_artists":      uniqueArtists,
+		"total_tracks_played": totals.played,
 		"avg_daily_listening": dailyAvgMinutes,
 		"listening_period": struct {
 			earliestTime time.Time
@@ -676,15 +756,10 @@ func calculateListeningStats(simplifiedTracks []SimplifiedTrack, totalMs int) ma
 
 }
 
-func processHeatmapData(simplifiedTrack []SimplifiedTrack) HeatmapData {
-	dateCountMap := make(map[string]int)
+func processHeatmapData(dateCountMap map[string]int) HeatmapData {
 	yearSet := make(map[int]bool)
 
-	for _, track := range simplifiedTrack {
-		datePart := track.Ts[:10]
-
-		dateCountMap[datePart]++
-
+	for datePart := range dateCountMap {
 		year, _ := time.Parse("2006-01-02", datePart)
 		yearSet[year.Year()] = true
 	}
@@ -726,19 +801,17 @@ type Days struct {
 	Day   time.Weekday `json:"day"`
 }
 
-func getWeekdayAnalysis(simplifiedTracks []SimplifiedTrack) WeekdayAnalysis {
+func getWeekdayAnalysis(dateCountMap map[string]int) WeekdayAnalysis {
 	daysMap := make(map[time.Weekday]int)
 
-	for _, track := range simplifiedTracks {
-		datePart := track.Ts[:10]
-
+	for datePart, count := range dateCountMap {
 		day, err := time.Parse("2006-01-02", datePart)
 
 		if err != nil {
 			continue
 		}
 
-		daysMap[day.Weekday()]++
+		daysMap[day.Weekday()] += count
 	}
 
 	weekends := make([]Days, 0)
@@ -795,122 +868,30 @@ func getWeekdayAnalysis(simplifiedTracks []SimplifiedTrack) WeekdayAnalysis {
 	}
 }
 
-func getLongestSession(simplifiedTracks []SimplifiedTrack) map[string]interface{} {
-	var currentSessionStart,
-		currentSessionEnd,
-		longestSessionStart,
-		longestSessionEnd,
-		previousTimestamp time.Time
-
-	var currentSessionDuration,
-		longestSessionDuration time.Duration
-
-	totalSessions := 0
-
-	currentArtistsMap := make(map[string]int)
-	currentTracksMap := make(map[string]int)
-
-	longestArtistsMap := make(map[string]int)
-	longestTracksMap := make(map[string]int)
-
-	sort.Slice(simplifiedTracks, func(i, j int) bool {
-		return simplifiedTracks[i].Ts < simplifiedTracks[j].Ts
-	})
-
-	layout := "2006-01-02T15:04:05Z"
-
-	for index, track := range simplifiedTracks {
-		currentDate, err := time.Parse(layout, track.Ts)
-
-		if err != nil {
-			fmt.Printf("Could not parse time for track at index: %d", index)
-			continue
-		}
-
-		if index == 0 {
-			currentSessionStart = currentDate
-			previousTimestamp = currentDate
-			totalSessions = 1
-
-			currentArtistsMap[track.Artist]++
-			currentTracksMap[track.Track]++
-
-			continue
-		}
-
-		diff := currentDate.Sub(previousTimestamp)
-		gap := diff.Minutes()
-
-		if gap >= 60 {
-			currentSessionEnd = previousTimestamp
-			currentSessionDuration = time.Duration(currentSessionEnd.Sub(currentSessionStart))
-
-			if currentSessionDuration > longestSessionDuration {
-				longestSessionDuration = currentSessionDuration
-				longestSessionStart = currentSessionStart
-				longestSessionEnd = currentSessionEnd
-
-				longestArtistsMap = make(map[string]int)
-				longestTracksMap = make(map[string]int)
-
-				// Copy current session data to longest
-				for k, v := range currentArtistsMap {
-					longestArtistsMap[k] = v
-				}
-				for k, v := range currentTracksMap {
-					longestTracksMap[k] = v
-				}
-			}
-
-			currentSessionStart = currentDate
-			totalSessions++
-
-			currentArtistsMap = make(map[string]int)
-			currentTracksMap = make(map[string]int)
-
-			currentArtistsMap[track.Artist]++
-			currentTracksMap[track.Track]++
-		} else {
-			currentArtistsMap[track.Artist]++
-			currentTracksMap[track.Track]++
-		}
-
-		previousTimestamp = currentDate
-	}
-
-	currentSessionEnd = previousTimestamp
-	currentSessionDuration = currentSessionEnd.Sub(currentSessionStart)
-
-	if currentSessionDuration > longestSessionDuration {
-		longestSessionStart = currentSessionStart
-		longestSessionEnd = currentSessionEnd
-		longestSessionDuration = currentSessionDuration
-
-		longestArtistsMap = currentArtistsMap
-		longestTracksMap = currentTracksMap
-	}
+func getLongestSession(sessions *sessionSummary) map[string]interface{} {
+	duration := sessions.end.Sub(sessions.start)
 
 	return map[string]interface{}{
-		"sessionStart":    longestSessionStart,
-		"sessionEnd":      longestSessionEnd,
-		"duration":        longestSessionDuration,
-		"durationMinutes": longestSessionDuration.Minutes(),
-		"totalSessions":   totalSessions,
+		"sessionStart":    sessions.start,
+		"sessionEnd":      sessions.end,
+		"duration":        duration,
+		"durationMinutes": duration.Minutes(),
+		"totalSessions":   sessions.count,
 		"session_insights": struct {
 			TotalTracks   int `json:"total_tracks"`
 			UniqueTracks  int `json:"unique_tracks"`
 			TotalArtists  int `json:"total_artists"`
 			UniqueArtists int `json:"unique_artists"`
 		}{
-			TotalTracks:   sumValues(longestTracksMap),
-			UniqueTracks:  len(longestTracksMap),
-			TotalArtists:  sumValues(longestArtistsMap),
-			UniqueArtists: len(longestArtistsMap),
+			TotalTracks:   sumValues(sessions.tracks),
+			UniqueTracks:  len(sessions.tracks),
+			TotalArtists:  sumValues(sessions.artists),
+			UniqueArtists: len(sessions.artists),
 		},
 	}
 }
 
-func sumValues(m map[string]int) int {
+func sumValues[K comparable](m map[K]int) int {
 	sum := 0
 	for _, v := range m {
 		sum += v
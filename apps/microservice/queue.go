@@ -1,45 +1,156 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
+)
+
+// A job that keeps taking the process down with it is dropped after this many
+// starts instead of being resumed forever.
+const maxJobAttempts = 3
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
+var (
+	ErrQueueClosed  = errors.New("queue is shutting down")
+	ErrQueueFull    = errors.New("queue is full")
+	ErrJobNotFound  = errors.New("job not found")
+	ErrJobFinished  = errors.New("job has already finished")
+	ErrJobCancelled = errors.New("job was cancelled")
 )
 
+// DuplicateJobError is returned by AddJob when the same job was already
+// submitted. State is the existing job's current state.
+type DuplicateJobError struct {
+	State JobState
+}
+
+func (e *DuplicateJobError) Error() string {
+	return fmt.Sprintf("job %s already exists (%s)", e.State.ProcessID, e.State.Status)
+}
+
 type Job struct {
-	S3Key     string
-	ProcessID string
-	UserID    string
+	S3Key      string    `json:"s3_key"`
+	ProcessID  string    `json:"process_id"`
+	UserID     string    `json:"user_id"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+	Attempts   int       `json:"attempts"`
+
+	IdempotencyKey string          `json:"idempotency_key,omitempty"`
+	Options        AnalysisOptions `json:"options"`
+
+	// Upload names the zip in the upload directory for jobs posted to
+	// /process/upload. Those have no S3Key.
+	Upload string `json:"upload,omitempty"`
+}
+
+type QueueConfig struct {
+	Workers     int
+	Depth       int
+	Blobs       BlobStore
+	Store       JobStore
+	DeadLetters *DeadLetterStore
+	Statuses    *StatusStore
+	Retry       RetryPolicy
+	WorkDir     string
+	UploadDir   string
+	Limits      JobLimits
+	Archive     ArchiveLimits
 }
 
 type Queue struct {
-	jobs       chan *Job
-	wg         sync.WaitGroup
-	workers    int
-	s3Client   *s3.Client
-	bucketName string
+	jobs          chan *Job
+	wg            sync.WaitGroup
+	workers       int
+	blobs         BlobStore
+	store         JobStore
+	deadLetters   *DeadLetterStore
+	retry         RetryPolicy
+	workDir       string
+	uploadDir     string
+	limits        JobLimits
+	archiveLimits ArchiveLimits
+	status        *StatusTracker
+
+	// quit is closed when Stop is called. mu guards closing jobs, so no
+	// sender is ever left writing to a closed channel.
+	quit     chan struct{}
+	stopOnce sync.Once
+	mu       sync.RWMutex
+	closed   bool
+
+	// ctx is the parent of every job's context. It is only cancelled when
+	// the shutdown deadline passes.
+	ctx     context.Context
+	abort   context.CancelCauseFunc
+	runMu   sync.Mutex
+	running map[string]context.CancelCauseFunc
 }
 
-func NewJobQueue(workers int, s3Client *s3.Client, bucketName string) *Queue {
+func NewJobQueue(cfg QueueConfig) *Queue {
+	ctx, abort := context.WithCancelCause(context.Background())
+
 	return &Queue{
-		jobs:       make(chan *Job, 100),
-		workers:    workers,
-		s3Client:   s3Client,
-		bucketName: bucketName,
+		jobs:          make(chan *Job, cfg.Depth),
+		workers:       cfg.Workers,
+		blobs:         cfg.Blobs,
+		store:         cfg.Store,
+		deadLetters:   cfg.DeadLetters,
+		retry:         cfg.Retry,
+		workDir:       cfg.WorkDir,
+		uploadDir:     cfg.UploadDir,
+		limits:        cfg.Limits,
+		archiveLimits: cfg.Archive,
+		status:        NewStatusTracker(cfg.Statuses),
+		quit:          make(chan struct{}),
+		ctx:           ctx,
+		abort:         abort,
+		running:       make(map[string]context.CancelCauseFunc),
 	}
 }
 
 func (q *Queue) Start() {
+	q.removeStaleWorkDirs()
+	q.removeOrphanUploads()
+
 	for i := 0; i < q.workers; i++ {
 		q.wg.Add(1)
 		go q.worker(i)
 	}
 
 	log.Printf("Started %d workers", q.workers)
+
+	// Finished jobs first, so a resumed job that was submitted again after
+	// failing replaces the state of its failed run.
+	if err := q.status.Load(); err != nil {
+		log.Printf("Failed to load job statuses: %v", err)
+	}
+
+	pending, err := q.store.Pending()
+	if err != nil {
+		log.Printf("Failed to load pending jobs: %v", err)
+		return
+	}
+
+	if len(pending) > 0 {
+		log.Printf("Resuming %d unfinished jobs", len(pending))
+
+		for _, job := range pending {
+			q.status.Queued(job)
+		}
+
+		go func() {
+			for _, job := range pending {
+				if err := q.enqueue(job); err != nil {
+					return
+				}
+			}
+		}()
+	}
 }
 
 func (q *Queue) worker(id int) {
@@ -48,61 +159,590 @@ func (q *Queue) worker(id int) {
 	log.Printf("Worker %d started", id)
 
 	for job := range q.jobs {
-		log.Printf("Worker %d processing job: %s", id, job.ProcessID)
+		// Once shutdown starts, leave whatever is still buffered in the
+		// store so it is resumed on the next start.
+		if q.stopping() {
+			continue
+		}
 
-		func(job *Job) {
-			tempDir, err := os.MkdirTemp("", "listening-history-*")
-			if err != nil {
-				log.Printf("Failed to create temp directory: %v", err)
-				return
-			}
+		q.run(id, job)
+	}
+}
 
-			defer os.RemoveAll(tempDir)
+func (q *Queue) run(id int, job *Job) {
+	ctx, cancel := context.WithCancelCause(q.ctx)
+	defer cancel(nil)
 
-			zipPath := filepath.Join(tempDir, "archive.zip")
-			err = DownloadFromS3(q.s3Client, q.bucketName, job.S3Key, zipPath)
-			if err != nil {
-				log.Printf("Failed to download file from S3: %v", err)
-				return
-			}
+	ctx, cancelTimeout := q.limits.WithDeadline(ctx)
+	defer cancelTimeout()
 
-			log.Printf("Successfully downloaded file for job: %s", job.ProcessID)
+	// Registering the job as running under runMu means Cancel either sees it
+	// running and cancels ctx, or has already marked it cancelled here.
+	// A cancelled job is skipped even when its process id was submitted
+	// again, which leaves its state untracked or tracking the new job.
+	q.runMu.Lock()
+	if state, ok := q.status.Get(job.ProcessID); !ok || state.Status == StatusCancelled || q.status.Superseded(job) {
+		q.runMu.Unlock()
+		log.Printf("Worker %d skipping cancelled job: %s", id, job.ProcessID)
+		q.removeUpload(job)
+		return
+	}
+	q.running[job.ProcessID] = cancel
+	q.runMu.Unlock()
 
-			extractDir := filepath.Join(tempDir, "extracted")
-			if err := os.Mkdir(extractDir, 0755); err != nil {
-				log.Printf("Failed to create extraction directory: %v", err)
-				return
-			}
+	defer func() {
+		q.runMu.Lock()
+		if !q.status.Superseded(job) {
+			delete(q.running, job.ProcessID)
+		}
+		q.runMu.Unlock()
+	}()
 
-			jsonFilePaths, err := ExtractAndFindAudioHistoryFiles(zipPath, extractDir)
-			if err != nil {
-				log.Printf("Failed to extract or find JSON file: %v", err)
-				return
-			}
+	job.Attempts++
 
-			log.Printf("Found JSON file at: %s", jsonFilePaths)
+	if job.Attempts > maxJobAttempts {
+		log.Printf("Worker %d dropping job %s after %d attempts", id, job.ProcessID, job.Attempts-1)
+		jobErr := NewJobError(ErrCodeInternal, fmt.Errorf("job was interrupted %d times", job.Attempts-1))
+		stage := q.status.Fail(job, jobErr)
+		q.reportFailure(job, jobErr)
+		q.park(job, stage, jobErr)
+		q.finish(job)
+		return
+	}
 
-			result, err := ProcessListeningHistoryFiles(jsonFilePaths, job.ProcessID)
-			if err != nil {
-				log.Printf("Failed to process listening history: %v", err)
-				return
-			}
+	if err := q.store.Save(job); err != nil {
+		log.Printf("Failed to record attempt for job %s: %v", job.ProcessID, err)
+	}
 
-			err = SendToBackend(q.s3Client, q.bucketName, result)
+	log.Printf("Worker %d processing job: %s (attempt %d)", id, job.ProcessID, job.Attempts)
 
-			if err != nil {
-				log.Printf("Something went wrong while sending results back to the backend")
-				fmt.Printf("Error:\n%v", err)
-				return
-			}
+	q.status.Started(job, id)
+
+	err := q.process(ctx, job)
+
+	switch {
+	case err == nil:
+		log.Printf("Worker %d completed job: %s", id, job.ProcessID)
+		q.status.Update(job, StatusCompleted)
+		q.removeUpload(job)
+	case errors.Is(context.Cause(ctx), ErrJobCancelled):
+		log.Printf("Worker %d stopped cancelled job: %s", id, job.ProcessID)
+		q.removeUpload(job)
+		if q.status.Superseded(job) {
+			// The main app has already submitted it again.
+			log.Printf("Not reporting cancellation of job %s, it was submitted again", job.ProcessID)
+		} else {
+			q.reportCancelled(job.ProcessID)
+		}
+	case errors.Is(context.Cause(ctx), ErrQueueClosed):
+		// Leave the job in the store so it is picked up again on restart.
+		// Only crashes count toward maxJobAttempts, not deploys.
+		log.Printf("Worker %d interrupted job %s for shutdown", id, job.ProcessID)
+		job.Attempts--
+		if err := q.store.Save(job); err != nil {
+			log.Printf("Failed to undo attempt for job %s: %v", job.ProcessID, err)
+		}
+		return
+	default:
+		// Report a blown wall-time limit rather than whatever step it
+		// happened to interrupt.
+		var limitErr *LimitError
+		if cause := context.Cause(ctx); errors.As(cause, &limitErr) {
+			err = cause
+		}
+
+		log.Printf("Worker %d failed job %s: %v", id, job.ProcessID, err)
+		jobErr := asJobError(err)
+		stage := q.status.Fail(job, err)
+		q.reportFailure(job, jobErr)
+		q.park(job, stage, jobErr)
+	}
+
+	q.finish(job)
+}
+
+func (q *Queue) process(ctx context.Context, job *Job) error {
+	tempDir, err := os.MkdirTemp(q.workDir, "listening-history-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %w", err)
+	}
+
+	defer os.RemoveAll(tempDir)
+
+	budget := NewJobBudget(q.limits)
+
+	zipPath, err := q.fetch(ctx, job, tempDir, budget)
+	if err != nil {
+		return err
+	}
+
+	q.status.Update(job, StatusExtracting)
+
+	archive, err := ExtractAndFindAudioHistoryFiles(ctx, zipPath, q.archiveLimits, budget)
+	if err != nil {
+		err = fmt.Errorf("failed to extract or find JSON file: %w", err)
+
+		var limitErr *LimitError
+		var archiveErr *ArchiveError
+
+		switch {
+		case errors.As(err, &limitErr):
+			return err
+		case errors.As(err, &archiveErr):
+			return NewJobError(ErrCodeUnsafeArchive, err)
+		case errors.Is(err, ErrInvalidArchive):
+			return NewJobError(ErrCodeInvalidArchive, err)
+		case errors.Is(err, ErrNoHistoryFiles):
+			return NewJobError(ErrCodeNoHistoryFiles, err)
+		default:
+			return err
+		}
+	}
+
+	defer archive.Close()
+
+	log.Printf("Found %d history files for job: %s", len(archive.Files), job.ProcessID)
+
+	q.status.Update(job, StatusParsing)
+
+	history, err := ParseListeningHistoryFiles(ctx, archive.Files, job.Options, budget)
+	if err != nil {
+		var archiveErr *ArchiveError
+		if errors.As(err, &archiveErr) {
+			return NewJobError(ErrCodeUnsafeArchive, err)
+		}
+
+		return q.limitOr(ErrCodeParseFailed, fmt.Errorf("failed to parse listening history: %w", err))
+	}
+
+	q.status.Update(job, StatusAnalyzing)
+
+	result, err := AnalyzeListeningHistory(ctx, history, job.ProcessID)
+	if err != nil {
+		return fmt.Errorf("failed to process listening history: %w", err)
+	}
+
+	if err := q.beginDelivery(ctx, job); err != nil {
+		return err
+	}
+
+	var requestBody *RequestBody
+	err = Retry(ctx, q.retry, "upload", func() error {
+		requestBody, err = UploadResult(ctx, q.blobs, result)
+		return err
+	})
+	if err != nil {
+		return NewJobError(ErrCodeUploadFailed, fmt.Errorf("failed to upload results: %w", err))
+	}
+
+	q.status.Update(job, StatusNotifying)
+
+	err = Retry(ctx, q.retry, "callback", func() error {
+		return SendToBackend(ctx, job.ProcessID, requestBody)
+	})
+	if err != nil {
+		return NewJobError(ErrCodeCallbackFailed, fmt.Errorf("failed to send results to the backend: %w", err))
+	}
+
+	log.Printf("Result Timing Message: %s", result.TimeMessage)
+
+	return nil
+}
+
+// fetch returns the path of the job's zip, downloading it into tempDir
+// unless it was uploaded straight to the service.
+func (q *Queue) fetch(ctx context.Context, job *Job, tempDir string, budget *JobBudget) (string, error) {
+	if job.Upload != "" {
+		zipPath := q.uploadPath(job)
+
+		info, err := os.Stat(zipPath)
+		if err != nil {
+			return "", NewJobError(ErrCodeDownloadFailed, fmt.Errorf("uploaded file is gone: %w", err))
+		}
+
+		if err := budget.CheckArchive(info.Size()); err != nil {
+			return "", err
+		}
+
+		if err := budget.AddDisk(info.Size()); err != nil {
+			return "", err
+		}
+
+		return zipPath, nil
+	}
+
+	q.status.Update(job, StatusDownloading)
+
+	zipPath := filepath.Join(tempDir, "archive.zip")
+	err := Retry(ctx, q.retry, "download", func() error {
+		return DownloadBlob(ctx, q.blobs, job.S3Key, zipPath, budget)
+	})
+	if err != nil {
+		return "", q.limitOr(ErrCodeDownloadFailed, fmt.Errorf("failed to download file: %w", err))
+	}
+
+	log.Printf("Successfully downloaded file for job: %s", job.ProcessID)
+
+	return zipPath, nil
+}
+
+// limitOr classifies err as the limit it hit, or as code if it didn't hit
+// one.
+func (q *Queue) limitOr(code ErrorCode, err error) error {
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		return err
+	}
+
+	return NewJobError(code, err)
+}
+
+// reportFailure lets the main app know a job failed so the user is not left
+// waiting. A failed callback is not reported again, since that would most
+// likely fail the same way.
+func (q *Queue) reportFailure(job *Job, jobErr *JobError) {
+	if jobErr.Code == ErrCodeCallbackFailed {
+		return
+	}
 
-			log.Printf("Result Timing Message: %s", result.TimeMessage)
+	err := Retry(q.ctx, q.retry, "failure callback", func() error {
+		return SendFailureToBackend(q.ctx, job.ProcessID, jobErr)
+	})
+	if err != nil {
+		log.Printf("Failed to report failure for job %s: %v", job.ProcessID, err)
+	}
+}
+
+// Cancel stops a job. A queued job is dropped before a worker gets to it;
+// a running job has its context cancelled, which stops it at the next
+// checkpoint and removes its temp dir. Either way the main app gets a
+// "cancelled" callback. Once a job has started uploading its results it is
+// past cancelling and ErrJobFinished is returned.
+func (q *Queue) Cancel(processID string) (JobState, error) {
+	q.runMu.Lock()
+	defer q.runMu.Unlock()
+
+	state, ok := q.status.Get(processID)
+	if !ok {
+		return JobState{}, ErrJobNotFound
+	}
+
+	if state.Status.Terminal() {
+		return state, ErrJobFinished
+	}
+
+	if state.Status == StatusUploading || state.Status == StatusNotifying {
+		// The results are already on their way to the main app.
+		return state, ErrJobFinished
+	}
+
+	if cancel, running := q.running[processID]; running {
+		// The worker reports the cancellation once it has stopped.
+		cancel(ErrJobCancelled)
+	} else if state.Status == StatusQueued {
+		// The worker that eventually receives it will skip it, but it
+		// must not come back after a restart either.
+		if err := q.store.Remove(processID); err != nil {
+			log.Printf("Failed to remove cancelled job %s from store: %v", processID, err)
+		}
+
+		go q.reportCancelled(processID)
+	} else {
+		// Picked up but already past processing; too late to stop it.
+		return state, ErrJobFinished
+	}
+
+	return q.status.Cancel(processID), nil
+}
+
+// beginDelivery moves a job on to uploading its results, unless it was
+// cancelled first. Holding runMu means Cancel either got in before, and the
+// job stops here, or sees it uploading and refuses, so the main app never
+// gets a cancellation after the results.
+func (q *Queue) beginDelivery(ctx context.Context, job *Job) error {
+	q.runMu.Lock()
+	defer q.runMu.Unlock()
+
+	if err := context.Cause(ctx); err != nil {
+		return err
+	}
+
+	q.status.Update(job, StatusUploading)
+
+	return nil
+}
+
+func (q *Queue) reportCancelled(processID string) {
+	err := Retry(q.ctx, q.retry, "cancel callback", func() error {
+		return SendFailureToBackend(q.ctx, processID, NewJobError(ErrCodeCancelled, ErrJobCancelled))
+	})
+	if err != nil {
+		log.Printf("Failed to report cancellation for job %s: %v", processID, err)
+	}
+}
+
+// park records a failed job in the dead letter store so it can be replayed
+// once whatever broke it is fixed, without the user uploading again.
+func (q *Queue) park(job *Job, stage JobStatus, jobErr *JobError) {
+	if _, err := q.deadLetters.Add(job, stage, jobErr); err != nil {
+		log.Printf("Failed to park job %s: %v", job.ProcessID, err)
+		return
+	}
+
+	log.Printf("Parked job %s in dead letters (failed while %s)", job.ProcessID, stage)
+}
+
+func (q *Queue) DeadLetters() ([]*DeadLetter, error) {
+	return q.deadLetters.List()
+}
+
+// Replay takes a dead letter and puts its job back on the queue.
+func (q *Queue) Replay(id string) error {
+	letter, err := q.deadLetters.Get(id)
+	if err != nil {
+		return err
+	}
+
+	job := letter.Job
+	job.Attempts = 0
+
+	if _, err := q.AddJob(&job); err != nil {
+		return err
+	}
+
+	return q.deadLetters.Remove(id)
+}
+
+// finish removes a job from the persistent store once a worker is done with
+// it, whether it succeeded or not.
+func (q *Queue) finish(job *Job) {
+	// The store file belongs to the new submission by now.
+	if q.status.Superseded(job) {
+		return
+	}
+
+	if err := q.store.Remove(job.ProcessID); err != nil {
+		log.Printf("Failed to remove job %s from store: %v", job.ProcessID, err)
+	}
+}
+
+// AddJob persists the job before queueing it, so it is not lost if the
+// process stops before a worker picks it up. It never blocks: when every
+// slot is taken it returns ErrQueueFull and the caller should try later.
+// On success it returns the job's position in the queue. Submitting a job
+// that is already queued, running or recently completed returns a
+// *DuplicateJobError instead.
+func (q *Queue) AddJob(job *Job) (int, error) {
+	if q.stopping() {
+		return 0, ErrQueueClosed
+	}
+
+	job.EnqueuedAt = time.Now()
+
+	if existing, ok := q.status.Admit(job); !ok {
+		return 0, &DuplicateJobError{State: existing}
+	}
+
+	if err := q.store.Save(job); err != nil {
+		q.status.Forget(job.ProcessID)
+		return 0, fmt.Errorf("failed to persist job: %w", err)
+	}
+
+	position, err := q.tryEnqueue(job)
+	if err != nil {
+		q.status.Forget(job.ProcessID)
+		q.finish(job)
+		return 0, err
+	}
+
+	return position, nil
+}
+
+// CheckJob returns the error AddJob would fail with right now, without
+// queueing job. It lets a caller turn a job away before doing expensive
+// work for it; AddJob still has the final say.
+func (q *Queue) CheckJob(job *Job) error {
+	if q.stopping() {
+		return ErrQueueClosed
+	}
+
+	if existing, ok := q.status.Duplicate(job); ok {
+		return &DuplicateJobError{State: existing}
+	}
+
+	if len(q.jobs) >= cap(q.jobs) {
+		return ErrQueueFull
+	}
+
+	return nil
+}
+
+func (q *Queue) tryEnqueue(job *Job) (int, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return 0, ErrQueueClosed
+	}
+
+	// Position 1 means the job is next in line.
+	position := len(q.jobs) + 1
+
+	select {
+	case q.jobs <- job:
+		return position, nil
+	default:
+		return 0, ErrQueueFull
+	}
+}
+
+// enqueue hands a job to the workers, waiting for a free slot. It gives up
+// if the queue is stopped in the meantime; the job stays in the store either
+// way.
+func (q *Queue) enqueue(job *Job) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	select {
+	case q.jobs <- job:
+		return nil
+	case <-q.quit:
+		return ErrQueueClosed
+	}
+}
+
+func (q *Queue) stopping() bool {
+	select {
+	case <-q.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop stops accepting jobs and waits for the workers to finish the ones
+// they are running. Jobs still running when ctx expires are cancelled and
+// left in the store, so they get resumed on the next start.
+func (q *Queue) Stop(ctx context.Context) error {
+	q.stopOnce.Do(func() {
+		close(q.quit)
+	})
+
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Printf("All workers stopped")
+		return nil
+	case <-ctx.Done():
+		running := q.status.Running()
+		for _, processID := range running {
+			log.Printf("Job %s was interrupted by shutdown and will be resumed on restart", processID)
+		}
+
+		q.abort(ErrQueueClosed)
+
+		// Give the workers a moment to notice and clean up their temp dirs.
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+
+		return fmt.Errorf("%d jobs did not finish before the shutdown deadline", len(running))
+	}
+}
+
+// removeStaleWorkDirs clears out temp dirs left behind by jobs that were
+// interrupted by a crash or an expired shutdown deadline.
+func (q *Queue) removeStaleWorkDirs() {
+	if q.workDir == "" {
+		return
+	}
+
+	stale, err := filepath.Glob(filepath.Join(q.workDir, "listening-history-*"))
+	if err != nil {
+		return
+	}
+
+	for _, dir := range stale {
+		log.Printf("Removing stale work directory: %s", dir)
+		os.RemoveAll(dir)
+	}
+}
+
+// uploadPath is where an uploaded job's zip lives. Only the base name of
+// job.Upload is used, so a tampered job file can't point outside the
+// upload directory.
+func (q *Queue) uploadPath(job *Job) string {
+	return filepath.Join(q.uploadDir, filepath.Base(job.Upload))
+}
+
+// removeUpload deletes an uploaded zip once its job has completed or was
+// cancelled. Failed jobs keep theirs so the dead letter can be replayed.
+func (q *Queue) removeUpload(job *Job) {
+	if job.Upload == "" {
+		return
+	}
+
+	if err := os.Remove(q.uploadPath(job)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove upload for job %s: %v", job.ProcessID, err)
+	}
+}
+
+// removeOrphanUploads deletes uploads that no pending job or dead letter
+// refers to, like half-received ones from a crash mid-request.
+func (q *Queue) removeOrphanUploads() {
+	if q.uploadDir == "" {
+		return
+	}
+
+	uploads, err := filepath.Glob(filepath.Join(q.uploadDir, "upload-*"))
+	if err != nil || len(uploads) == 0 {
+		return
+	}
+
+	pending, err := q.store.Pending()
+	if err != nil {
+		return
+	}
+
+	letters, err := q.deadLetters.List()
+	if err != nil {
+		return
+	}
+
+	inUse := make(map[string]bool)
+	for _, job := range pending {
+		inUse[q.uploadPath(job)] = true
+	}
+	for _, letter := range letters {
+		inUse[q.uploadPath(&letter.Job)] = true
+	}
 
-			log.Printf("Worker %d completed job: %s", id, job.ProcessID)
-		}(job)
+	for _, path := range uploads {
+		if !inUse[path] {
+			log.Printf("Removing orphaned upload: %s", path)
+			os.Remove(path)
+		}
 	}
 }
 
-func (q *Queue) AddJob(job *Job) {
-	q.jobs <- job
+// Status reports the current lifecycle state of a job.
+func (q *Queue) Status(processID string) (JobState, bool) {
+	return q.status.Get(processID)
 }
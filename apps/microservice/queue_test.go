@@ -0,0 +1,669 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestQueue(t *testing.T, dir string, blobs BlobStore, store JobStore) *Queue {
+	t.Helper()
+
+	deadLetters, err := NewDeadLetterStore(filepath.Join(dir, "dead-letters"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err := NewStatusStore(filepath.Join(dir, "status"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewJobQueue(QueueConfig{
+		Workers:     1,
+		Depth:       10,
+		Blobs:       blobs,
+		Store:       store,
+		DeadLetters: deadLetters,
+		Statuses:    statuses,
+		Retry:       RetryPolicy{Attempts: 1, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		WorkDir:     t.TempDir(),
+		UploadDir:   filepath.Join(dir, "uploads"),
+		Limits:      DefaultJobLimits(),
+		Archive:     DefaultArchiveLimits(),
+	})
+}
+
+func stopQueue(t *testing.T, q *Queue, timeout time.Duration) error {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return q.Stop(ctx)
+}
+
+// blockingBlobStore never finishes a download, like a worker that is still
+// busy when the process goes down.
+type blockingBlobStore struct {
+	started chan string
+}
+
+func (s *blockingBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	s.started <- key
+	<-ctx.Done()
+	return nil, 0, ctx.Err()
+}
+
+func (s *blockingBlobStore) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	return errors.New("not supported")
+}
+
+// spyJobStore records what the queue had reported to the main app by the
+// time each job was removed from the store.
+type spyJobStore struct {
+	JobStore
+	stub *mainAppStub
+
+	mu      sync.Mutex
+	removed map[string][]callback
+}
+
+func (s *spyJobStore) Remove(processID string) error {
+	s.mu.Lock()
+	s.removed[processID] = s.stub.received()
+	s.mu.Unlock()
+
+	return s.JobStore.Remove(processID)
+}
+
+func (s *spyJobStore) removedWith(processID string) ([]callback, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	callbacks, ok := s.removed[processID]
+	return callbacks, ok
+}
+
+func TestQueueResumesJobInterruptedByShutdown(t *testing.T) {
+	stub := newMainAppStub(t)
+	dir := t.TempDir()
+	queueDir := filepath.Join(dir, "queue")
+
+	fileStore, err := NewFileJobStore(queueDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &spyJobStore{JobStore: fileStore, stub: stub, removed: make(map[string][]callback)}
+
+	// More deploys than maxJobAttempts interrupt the job while it is still
+	// downloading, each one after the shutdown deadline.
+	for i := 0; i <= maxJobAttempts; i++ {
+		blocking := &blockingBlobStore{started: make(chan string, 1)}
+		q := newTestQueue(t, dir, blocking, store)
+		q.Start()
+
+		if i == 0 {
+			if _, err := q.AddJob(&Job{S3Key: "exports/p1.zip", ProcessID: "p1", UserID: "u1"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		select {
+		case <-blocking.started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("job was not started after %d restarts", i)
+		}
+
+		if err := stopQueue(t, q, 50*time.Millisecond); err == nil {
+			t.Fatal("expected the interrupted job to be reported by Stop")
+		}
+
+		if _, ok := store.removedWith("p1"); ok {
+			t.Fatal("interrupted job was removed from the store")
+		}
+
+		// A shutdown isn't a crash, so it doesn't use up an attempt.
+		waitFor(t, "attempt to be given back", func() bool {
+			pending, _ := fileStore.Pending()
+			return len(pending) == 1 && pending[0].ProcessID == "p1" && pending[0].Attempts == 0
+		})
+	}
+
+	// A new process over the same queue directory picks it up again.
+	reopened, err := NewFileJobStore(queueDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.JobStore = reopened
+
+	blobs := NewMemoryBlobStore()
+	blobs.blobs["exports/p1.zip"] = testExportBytes(t, testTracks(200))
+
+	second := newTestQueue(t, dir, blobs, store)
+	second.Start()
+	defer stopQueue(t, second, 5*time.Second)
+
+	waitFor(t, "resumed job to be removed", func() bool {
+		_, ok := store.removedWith("p1")
+		return ok
+	})
+
+	state, _ := second.Status("p1")
+	if state.Status != StatusCompleted {
+		t.Fatalf("resumed job status = %s, want %s", state.Status, StatusCompleted)
+	}
+
+	callbacks, _ := store.removedWith("p1")
+	if len(callbacks) != 1 || !callbacks[0].Body.Success {
+		t.Fatalf("callbacks before removal = %+v, want one successful result", callbacks)
+	}
+
+	if pending, _ := reopened.Pending(); len(pending) != 0 {
+		t.Fatalf("pending after completion = %v, want none", pending)
+	}
+}
+
+func TestQueueDropsJobAfterMaxAttempts(t *testing.T) {
+	stub := newMainAppStub(t)
+	dir := t.TempDir()
+
+	store, err := NewFileJobStore(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A job that has taken the process down every time it was started.
+	job := &Job{S3Key: "exports/p1.zip", ProcessID: "p1", UserID: "u1", Attempts: maxJobAttempts}
+	if err := store.Save(job); err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := NewMemoryBlobStore()
+	blobs.blobs["exports/p1.zip"] = testExportBytes(t, testTracks(10))
+
+	q := newTestQueue(t, dir, blobs, store)
+	q.Start()
+	defer stopQueue(t, q, 5*time.Second)
+
+	waitFor(t, "job to be dropped", func() bool {
+		state, ok := q.Status("p1")
+		return ok && state.Status == StatusFailed
+	})
+
+	waitFor(t, "failure callback", func() bool {
+		return len(stub.received()) > 0
+	})
+
+	callbacks := stub.received()
+	if len(callbacks) != 1 || callbacks[0].Body.Success || callbacks[0].Body.ErrorCode != ErrCodeInternal {
+		t.Fatalf("callbacks = %+v, want one %s failure", callbacks, ErrCodeInternal)
+	}
+
+	letter, err := q.deadLetters.Get("p1")
+	if err != nil {
+		t.Fatalf("dropped job was not parked: %v", err)
+	}
+	if letter.ErrorCode != ErrCodeInternal {
+		t.Fatalf("dead letter code = %s, want %s", letter.ErrorCode, ErrCodeInternal)
+	}
+
+	if pending, _ := store.Pending(); len(pending) != 0 {
+		t.Fatalf("pending after drop = %v, want none", pending)
+	}
+}
+
+// gatedBlobStore serves exports from memory but holds every Put until it
+// is released.
+type gatedBlobStore struct {
+	*MemoryBlobStore
+	putting chan string
+	release chan struct{}
+}
+
+func (s *gatedBlobStore) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	s.putting <- key
+	<-s.release
+	return s.MemoryBlobStore.Put(ctx, key, body, opts)
+}
+
+func TestCancelIsRefusedOnceResultsAreUploading(t *testing.T) {
+	stub := newMainAppStub(t)
+	dir := t.TempDir()
+
+	store, err := NewFileJobStore(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := &gatedBlobStore{
+		MemoryBlobStore: NewMemoryBlobStore(),
+		putting:         make(chan string, 1),
+		release:         make(chan struct{}),
+	}
+	blobs.blobs["exports/p1.zip"] = testExportBytes(t, testTracks(10))
+
+	q := newTestQueue(t, dir, blobs, store)
+	q.Start()
+	defer stopQueue(t, q, 5*time.Second)
+
+	if _, err := q.AddJob(&Job{S3Key: "exports/p1.zip", ProcessID: "p1", UserID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	<-blobs.putting
+
+	if _, err := q.Cancel("p1"); !errors.Is(err, ErrJobFinished) {
+		t.Fatalf("cancel while uploading = %v, want ErrJobFinished", err)
+	}
+
+	close(blobs.release)
+
+	waitFor(t, "job to complete", func() bool {
+		state, _ := q.Status("p1")
+		return state.Status == StatusCompleted
+	})
+
+	callbacks := stub.received()
+	if len(callbacks) != 1 || !callbacks[0].Body.Success {
+		t.Fatalf("callbacks = %+v, want only the result", callbacks)
+	}
+}
+
+func TestCancelledRunningJobIsReportedOnce(t *testing.T) {
+	stub := newMainAppStub(t)
+	dir := t.TempDir()
+
+	store, err := NewFileJobStore(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocking := &blockingBlobStore{started: make(chan string, 1)}
+
+	q := newTestQueue(t, dir, blocking, store)
+	q.Start()
+	defer stopQueue(t, q, 5*time.Second)
+
+	if _, err := q.AddJob(&Job{S3Key: "exports/p1.zip", ProcessID: "p1", UserID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	<-blocking.started
+
+	state, err := q.Cancel("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Status != StatusCancelled {
+		t.Fatalf("status = %s, want %s", state.Status, StatusCancelled)
+	}
+
+	waitFor(t, "cancel callback", func() bool {
+		return len(stub.received()) > 0
+	})
+
+	callbacks := stub.received()
+	if len(callbacks) != 1 || callbacks[0].Body.ErrorCode != ErrCodeCancelled {
+		t.Fatalf("callbacks = %+v, want one %s", callbacks, ErrCodeCancelled)
+	}
+
+	waitFor(t, "cancelled job to leave the store", func() bool {
+		pending, _ := store.Pending()
+		return len(pending) == 0
+	})
+
+	waitFor(t, "work dir to be removed", func() bool {
+		entries, _ := os.ReadDir(q.workDir)
+		return len(entries) == 0
+	})
+}
+
+// heldBlobStore never finishes downloading one key, to keep the only worker
+// busy, and serves every other key.
+type heldBlobStore struct {
+	*countingBlobStore
+	held    string
+	started chan string
+}
+
+func (s *heldBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	if key == s.held {
+		s.started <- key
+		<-ctx.Done()
+		return nil, 0, ctx.Err()
+	}
+
+	return s.countingBlobStore.Get(ctx, key)
+}
+
+func TestCancelledQueuedJobCanBeSubmittedAgain(t *testing.T) {
+	stub := newMainAppStub(t)
+	dir := t.TempDir()
+
+	store, err := NewFileJobStore(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := &heldBlobStore{
+		countingBlobStore: &countingBlobStore{MemoryBlobStore: NewMemoryBlobStore(), gets: map[string]int{}},
+		held:              "exports/p1.zip",
+		started:           make(chan string, 1),
+	}
+	blobs.blobs["exports/p2.zip"] = testExportBytes(t, testTracks(10))
+
+	q := newTestQueue(t, dir, blobs, store)
+	q.Start()
+	defer stopQueue(t, q, 5*time.Second)
+
+	if _, err := q.AddJob(&Job{S3Key: "exports/p1.zip", ProcessID: "p1", UserID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	<-blobs.started
+
+	if _, err := q.AddJob(&Job{S3Key: "exports/p2.zip", ProcessID: "p2", UserID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := q.Cancel("p2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Status != StatusCancelled {
+		t.Fatalf("status = %s, want %s", state.Status, StatusCancelled)
+	}
+
+	waitFor(t, "cancel callback", func() bool {
+		return len(stub.received()) > 0
+	})
+
+	// The cancelled p2 is still waiting behind p1.
+	if _, err := q.AddJob(&Job{S3Key: "exports/p2.zip", ProcessID: "p2", UserID: "u1"}); err != nil {
+		t.Fatalf("submitting a cancelled job again = %v, want it queued", err)
+	}
+
+	if _, err := q.Cancel("p1"); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "p2 to complete", func() bool {
+		state, _ := q.Status("p2")
+		return state.Status == StatusCompleted
+	})
+
+	results := map[string][]string{}
+	waitFor(t, "callbacks", func() bool {
+		return len(stub.received()) == 3
+	})
+	for _, callback := range stub.received() {
+		outcome := string(callback.Body.ErrorCode)
+		if callback.Body.Success {
+			outcome = "success"
+		}
+		results[callback.ProcessID] = append(results[callback.ProcessID], outcome)
+	}
+
+	if fmt.Sprint(results["p1"]) != fmt.Sprint([]string{string(ErrCodeCancelled)}) ||
+		fmt.Sprint(results["p2"]) != fmt.Sprint([]string{string(ErrCodeCancelled), "success"}) {
+		t.Fatalf("callbacks = %v, want p1 cancelled and p2 cancelled, then run once", results)
+	}
+
+	if gets := blobs.gets["exports/p2.zip"]; gets != 1 {
+		t.Fatalf("p2 was downloaded %d times, want once", gets)
+	}
+
+	waitFor(t, "jobs to leave the store", func() bool {
+		pending, _ := store.Pending()
+		return len(pending) == 0
+	})
+
+	entries, err := os.ReadDir(q.workDir)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("work dir holds %d entries (%v), want none", len(entries), err)
+	}
+}
+
+func TestCheckJobMatchesAddJob(t *testing.T) {
+	newMainAppStub(t)
+	dir := t.TempDir()
+
+	store, err := NewFileJobStore(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocking := &blockingBlobStore{started: make(chan string, 1)}
+	q := newTestQueue(t, dir, blocking, store)
+	q.Start()
+
+	running := &Job{S3Key: "exports/p0.zip", ProcessID: "p0", UserID: "u1", IdempotencyKey: "k0"}
+	if _, err := q.AddJob(running); err != nil {
+		t.Fatal(err)
+	}
+	<-blocking.started
+
+	var duplicate *DuplicateJobError
+	if err := q.CheckJob(&Job{ProcessID: "p0"}); !errors.As(err, &duplicate) {
+		t.Fatalf("check of a running process id = %v, want a duplicate", err)
+	}
+	if err := q.CheckJob(&Job{ProcessID: "other", IdempotencyKey: "k0"}); !errors.As(err, &duplicate) {
+		t.Fatalf("check of a used idempotency key = %v, want a duplicate", err)
+	}
+
+	// Fill every slot behind the running job.
+	for i := 1; i <= 10; i++ {
+		job := &Job{S3Key: "exports/p.zip", ProcessID: fmt.Sprintf("p%d", i), UserID: "u1"}
+		if err := q.CheckJob(job); err != nil {
+			t.Fatalf("check with a free slot = %v", err)
+		}
+		if _, err := q.AddJob(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := q.CheckJob(&Job{ProcessID: "p11"}); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("check of a full queue = %v, want ErrQueueFull", err)
+	}
+
+	stopQueue(t, q, 50*time.Millisecond)
+
+	if err := q.CheckJob(&Job{ProcessID: "p11"}); !errors.Is(err, ErrQueueClosed) {
+		t.Fatalf("check after shutdown = %v, want ErrQueueClosed", err)
+	}
+}
+
+// crashHelperEnv names the queue directory TestQueueCrashHelper runs on
+// when it is started by TestQueueRecoversFromCrash.
+const crashHelperEnv = "CRASH_HELPER_QUEUE_DIR"
+
+// TestQueueCrashHelper is the process TestQueueRecoversFromCrash kills. It
+// queues a download that never finishes and an upload behind it, leaves an
+// upload that was never queued, and waits to be killed.
+func TestQueueCrashHelper(t *testing.T) {
+	queueDir := os.Getenv(crashHelperEnv)
+	if queueDir == "" {
+		t.Skip("only run by TestQueueRecoversFromCrash")
+	}
+
+	store, err := NewFileJobStore(queueDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocking := &blockingBlobStore{started: make(chan string, 1)}
+	q := newTestQueue(t, filepath.Dir(queueDir), blocking, store)
+	q.Start()
+
+	if err := os.MkdirAll(q.uploadDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(q.uploadDir, "upload-orphan.zip"), []byte("PK"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	writeTestExport(t, filepath.Join(q.uploadDir, "upload-p2.zip"), testTracks(50))
+
+	if _, err := q.AddJob(&Job{S3Key: "exports/p1.zip", ProcessID: "p1", UserID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.AddJob(&Job{ProcessID: "p2", UserID: "u1", Upload: "upload-p2.zip"}); err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Printf("downloading %s\n", <-blocking.started)
+
+	time.Sleep(time.Minute)
+	t.Fatal("helper was not killed")
+}
+
+// attemptsJobStore records the attempt count each job was last saved with.
+type attemptsJobStore struct {
+	JobStore
+
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+func (s *attemptsJobStore) Save(job *Job) error {
+	s.mu.Lock()
+	s.attempts[job.ProcessID] = job.Attempts
+	s.mu.Unlock()
+
+	return s.JobStore.Save(job)
+}
+
+// countingBlobStore counts downloads per key.
+type countingBlobStore struct {
+	*MemoryBlobStore
+
+	mu   sync.Mutex
+	gets map[string]int
+}
+
+func (s *countingBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	s.mu.Lock()
+	s.gets[key]++
+	s.mu.Unlock()
+
+	return s.MemoryBlobStore.Get(ctx, key)
+}
+
+func TestQueueRecoversFromCrash(t *testing.T) {
+	stub := newMainAppStub(t)
+	dir := t.TempDir()
+	queueDir := filepath.Join(dir, "queue")
+
+	// The helper's temp dirs go under dir, since it never gets to clean up.
+	tmp := filepath.Join(dir, "tmp")
+	if err := os.Mkdir(tmp, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestQueueCrashHelper$")
+	cmd.Env = append(os.Environ(), crashHelperEnv+"="+queueDir, "TMPDIR="+tmp)
+	cmd.Stderr = os.Stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	downloading := make(chan bool, 1)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			if scanner.Text() == "downloading exports/p1.zip" {
+				downloading <- true
+				break
+			}
+		}
+		io.Copy(io.Discard, stdout)
+		close(downloading)
+	}()
+
+	select {
+	case ok := <-downloading:
+		if !ok {
+			cmd.Wait()
+			t.Fatal("helper exited before the job was downloading")
+		}
+	case <-time.After(30 * time.Second):
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Fatal("helper never started the job")
+	}
+
+	// Kill sends SIGKILL, so nothing gets to shut down cleanly.
+	if err := cmd.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Wait()
+
+	fileStore, err := NewFileJobStore(queueDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := fileStore.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attempts := map[string]int{}
+	for _, job := range pending {
+		attempts[job.ProcessID] = job.Attempts
+	}
+	if len(attempts) != 2 || attempts["p1"] != 1 || attempts["p2"] != 0 {
+		t.Fatalf("attempts after the crash = %v, want p1 started once and p2 not at all", attempts)
+	}
+
+	store := &attemptsJobStore{JobStore: fileStore, attempts: make(map[string]int)}
+	blobs := &countingBlobStore{MemoryBlobStore: NewMemoryBlobStore(), gets: make(map[string]int)}
+	blobs.blobs["exports/p1.zip"] = testExportBytes(t, testTracks(50))
+
+	q := newTestQueue(t, dir, blobs, store)
+	q.Start()
+	defer stopQueue(t, q, 5*time.Second)
+
+	waitFor(t, "both jobs to be reported", func() bool {
+		return len(stub.received()) == 2
+	})
+	waitFor(t, "both jobs to leave the store", func() bool {
+		pending, _ := fileStore.Pending()
+		return len(pending) == 0
+	})
+
+	for _, callback := range stub.received() {
+		if !callback.Body.Success {
+			t.Errorf("job %s failed after the restart: %+v", callback.ProcessID, callback.Body)
+		}
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.attempts["p1"] != 2 || store.attempts["p2"] != 1 {
+		t.Errorf("attempts after the restart = %v, want p1 on its second and p2 on its first", store.attempts)
+	}
+
+	blobs.mu.Lock()
+	defer blobs.mu.Unlock()
+	if blobs.gets["exports/p1.zip"] != 1 {
+		t.Errorf("p1 was downloaded %d times after the restart, want once", blobs.gets["exports/p1.zip"])
+	}
+
+	uploads, _ := filepath.Glob(filepath.Join(q.uploadDir, "*"))
+	if len(uploads) != 0 {
+		t.Errorf("uploads left after the restart = %v, want none", uploads)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+var ErrRetriesExhausted = errors.New("retries exhausted")
+
+type RetryPolicy struct {
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts:  4,
+		BaseDelay: time.Second,
+		MaxDelay:  30 * time.Second,
+	}
+}
+
+// HTTPStatusError is returned when the main app answers with a non-2xx status.
+type HTTPStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("request failed with status %d: %s", e.StatusCode, e.Body)
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks an error as one that retrying will not fix.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// S3 error codes that won't go away by asking again.
+var fatalS3Codes = map[string]bool{
+	"NoSuchKey":             true,
+	"NoSuchBucket":          true,
+	"AccessDenied":          true,
+	"InvalidAccessKeyId":    true,
+	"SignatureDoesNotMatch": true,
+	"InvalidBucketName":     true,
+}
+
+// IsRetryable decides whether an operation that failed with err is worth
+// trying again. Anything not known to be fatal is treated as transient.
+func IsRetryable(err error) bool {
+	var permanent *permanentError
+	if errors.As(err, &permanent) {
+		return false
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) || errors.Is(err, ErrBlobNotFound) {
+		return false
+	}
+
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == 429 || statusErr.StatusCode == 408
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return !fatalS3Codes[apiErr.ErrorCode()]
+	}
+
+	return true
+}
+
+// Retry runs op until it succeeds, fails with a fatal error or runs out of
+// attempts. Once attempts are exhausted the returned error wraps
+// ErrRetriesExhausted.
+func Retry(ctx context.Context, policy RetryPolicy, name string, op func() error) error {
+	attempts := max(policy.Attempts, 1)
+
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+
+		if !IsRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		if attempt >= attempts {
+			return fmt.Errorf("%w: %s failed %d times: %w", ErrRetriesExhausted, name, attempt, err)
+		}
+
+		delay := policy.backoff(attempt)
+		log.Printf("%s failed (attempt %d/%d), retrying in %s: %v", name, attempt, attempts, delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// backoff doubles the delay with every attempt up to MaxDelay, then picks a
+// random point in the upper half so retrying workers don't line up.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << (attempt - 1)
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"400", &HTTPStatusError{StatusCode: 400}, false},
+		{"401", &HTTPStatusError{StatusCode: 401}, false},
+		{"404", &HTTPStatusError{StatusCode: 404}, false},
+		{"408", &HTTPStatusError{StatusCode: 408}, true},
+		{"429", &HTTPStatusError{StatusCode: 429}, true},
+		{"500", &HTTPStatusError{StatusCode: 500}, true},
+		{"503 wrapped", fmt.Errorf("callback: %w", &HTTPStatusError{StatusCode: 503}), true},
+		{"NoSuchKey", &smithy.GenericAPIError{Code: "NoSuchKey"}, false},
+		{"AccessDenied", &smithy.GenericAPIError{Code: "AccessDenied"}, false},
+		{"SlowDown", &smithy.GenericAPIError{Code: "SlowDown"}, true},
+		{"permanent", Permanent(errors.New("bad export")), false},
+		{"permanent wrapped", fmt.Errorf("parse: %w", Permanent(errors.New("bad export"))), false},
+		{"limit", &LimitError{Code: ErrCodeLimitDisk}, false},
+		{"blob not found", ErrBlobNotFound, false},
+		{"cancelled", context.Canceled, false},
+		{"unknown", errors.New("connection reset"), true},
+	}
+
+	for _, tt := range tests {
+		if got := IsRetryable(tt.err); got != tt.want {
+			t.Errorf("IsRetryable(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	policy := RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	transient := errors.New("connection reset")
+
+	tests := []struct {
+		name     string
+		failures int
+		err      error
+		wantErr  error
+		wantRuns int
+	}{
+		{"succeeds first time", 0, transient, nil, 1},
+		{"succeeds on last attempt", 2, transient, nil, 3},
+		{"stops after attempts", 5, transient, ErrRetriesExhausted, 3},
+		{"stops on a fatal error", 5, &HTTPStatusError{StatusCode: 400}, &HTTPStatusError{}, 1},
+		{"stops on a permanent error", 5, Permanent(transient), transient, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs := 0
+			err := Retry(context.Background(), policy, "op", func() error {
+				runs++
+				if runs <= tt.failures {
+					return tt.err
+				}
+				return nil
+			})
+
+			if runs != tt.wantRuns {
+				t.Errorf("ran %d times, want %d", runs, tt.wantRuns)
+			}
+
+			var statusErr *HTTPStatusError
+			switch {
+			case tt.wantErr == nil:
+				if err != nil {
+					t.Errorf("err = %v, want nil", err)
+				}
+			case errors.As(tt.wantErr, &statusErr):
+				if !errors.As(err, &statusErr) {
+					t.Errorf("err = %v, want the status error", err)
+				}
+			case !errors.Is(err, tt.wantErr):
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetryStopsWhenContextIsCancelled(t *testing.T) {
+	policy := RetryPolicy{Attempts: 10, BaseDelay: time.Hour, MaxDelay: time.Hour}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runs := 0
+	done := make(chan error, 1)
+	go func() {
+		done <- Retry(ctx, policy, "op", func() error {
+			runs++
+			return errors.New("connection reset")
+		})
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) || runs != 1 {
+			t.Fatalf("Retry = %v after %d runs, want context.Canceled after 1", err, runs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Retry kept waiting after the context was cancelled")
+	}
+
+	// An op that fails because of the cancellation is not tried again.
+	runs = 0
+	err := Retry(ctx, RetryPolicy{Attempts: 10}, "op", func() error {
+		runs++
+		return fmt.Errorf("download: %w", errors.New("connection closed"))
+	})
+	if err == nil || runs != 1 {
+		t.Fatalf("Retry with a cancelled context ran %d times (%v), want once", runs, err)
+	}
+}
+
+func TestBackoffStaysWithinMaxDelay(t *testing.T) {
+	policy := RetryPolicy{Attempts: 100, BaseDelay: time.Second, MaxDelay: 30 * time.Second}
+
+	if delay := policy.backoff(1); delay < policy.BaseDelay/2 || delay > policy.BaseDelay {
+		t.Fatalf("backoff(1) = %s, want between %s and %s", delay, policy.BaseDelay/2, policy.BaseDelay)
+	}
+
+	// Past the doubling, and past where shifting overflows, every delay is
+	// in the upper half of MaxDelay.
+	for attempt := 6; attempt <= 100; attempt++ {
+		if delay := policy.backoff(attempt); delay < policy.MaxDelay/2 || delay > policy.MaxDelay {
+			t.Fatalf("backoff(%d) = %s, want between %s and %s", attempt, delay, policy.MaxDelay/2, policy.MaxDelay)
+		}
+	}
+
+	if delay := (RetryPolicy{}).backoff(1); delay != 0 {
+		t.Fatalf("backoff without delays = %s, want 0", delay)
+	}
+}
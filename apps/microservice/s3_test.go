@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// newTestS3BlobStore connects to the S3 compatible server at
+// S3_TEST_ENDPOINT, for example a local MinIO:
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//	S3_TEST_ENDPOINT=http://localhost:9000 go test -run S3 ./...
+//
+// The store is set up from the environment the same way the service does it,
+// with path style addressing, and the bucket is created if it doesn't exist.
+func newTestS3BlobStore(t *testing.T) *S3BlobStore {
+	t.Helper()
+
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT is not set")
+	}
+
+	t.Setenv("S3_ENDPOINT_URL", endpoint)
+	t.Setenv("S3_FORCE_PATH_STYLE", "true")
+	t.Setenv("S3_BUCKET_NAME", envString("S3_TEST_BUCKET", "my-stats-test"))
+	t.Setenv("AWS_REGION", envString("S3_TEST_REGION", "us-east-1"))
+	t.Setenv("AWS_ACCESS_KEY_ID", envString("S3_TEST_ACCESS_KEY", "minioadmin"))
+	t.Setenv("AWS_SECRET_ACCESS_KEY", envString("S3_TEST_SECRET_KEY", "minioadmin"))
+	t.Setenv("AWS_SESSION_TOKEN", "")
+
+	ctx := context.Background()
+
+	blobs, err := s3BlobStoreFromEnv(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := blobs.(*S3BlobStore)
+
+	_, err = store.client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(store.bucket)})
+	var owned *types.BucketAlreadyOwnedByYou
+	var exists *types.BucketAlreadyExists
+	if err != nil && !errors.As(err, &owned) && !errors.As(err, &exists) {
+		t.Fatalf("failed to create bucket %s: %v", store.bucket, err)
+	}
+
+	return store
+}
+
+// partCounter counts the UploadPart requests a client sends.
+type partCounter struct {
+	next  aws.HTTPClient
+	parts atomic.Int32
+}
+
+func (c *partCounter) Do(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodPut && req.URL.Query().Has("partNumber") {
+		c.parts.Add(1)
+	}
+	return c.next.Do(req)
+}
+
+func testS3Key(t *testing.T, name string) string {
+	return "test/" + strings.ReplaceAll(t.Name(), "/", "-") + "/" + name
+}
+
+func TestS3BlobStoreRoundTrip(t *testing.T) {
+	configured := newTestS3BlobStore(t)
+	ctx := context.Background()
+	key := testS3Key(t, "result.json.gz")
+
+	options := configured.client.Options()
+	counter := &partCounter{next: options.HTTPClient}
+	options.HTTPClient = counter
+	store := NewS3BlobStore(s3.New(options), configured.bucket)
+
+	// Bigger than the uploader's 5 MiB part size, and read through a plain
+	// io.Reader so the length isn't known up front, like the result stream.
+	data := make([]byte, 12<<20)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	err := store.Put(ctx, key, io.MultiReader(bytes.NewReader(data)), PutOptions{
+		ContentType: "application/gzip",
+		Metadata:    map[string]string{"process-id": "p1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		store.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+			Bucket: aws.String(store.bucket),
+			Key:    aws.String(key),
+		})
+	})
+
+	if parts := counter.parts.Load(); parts < 2 {
+		t.Errorf("uploaded in %d parts, want a multipart upload", parts)
+	}
+
+	head, err := store.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if contentType := aws.ToString(head.ContentType); contentType != "application/gzip" {
+		t.Errorf("content type = %q, want application/gzip", contentType)
+	}
+	if processID := head.Metadata["process-id"]; processID != "p1" {
+		t.Errorf("process-id metadata = %q, want p1", processID)
+	}
+
+	body, size, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+
+	if size != int64(len(data)) {
+		t.Errorf("size = %d, want %d", size, len(data))
+	}
+
+	got, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("read back %d bytes that differ from the %d written", len(got), len(data))
+	}
+}
+
+func TestS3BlobStoreMissingKey(t *testing.T) {
+	store := newTestS3BlobStore(t)
+
+	_, _, err := store.Get(context.Background(), testS3Key(t, "missing.zip"))
+	if !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("Get of a missing key = %v, want ErrBlobNotFound", err)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"sort"
+)
+
+const (
+	// An artist or album needs at least this many plays before we'll say
+	// it's mostly played in order.
+	minInOrderPlays = 10
+
+	// The share of plays that must have had shuffle off.
+	mostlyInOrderRate = 0.8
+)
+
+type ShuffleShare struct {
+	Plays        int     `json:"plays"`
+	Shuffled     int     `json:"shuffled"`
+	ShuffleShare float64 `json:"shuffle_share"`
+}
+
+type MonthShuffleShare struct {
+	Month string `json:"month"`
+	ShuffleShare
+}
+
+type InOrderArtist struct {
+	Artist string `json:"artist"`
+	ShuffleShare
+}
+
+type InOrderAlbum struct {
+	Album  string `json:"album"`
+	Artist string `json:"artist"`
+	ShuffleShare
+}
+
+// ShuffleAnalysis separates shuffled plays from deliberate ones. Like
+// SkipAnalysis it looks at every music entry, and Available is false when the
+// export doesn't say whether shuffle was on.
+type ShuffleAnalysis struct {
+	Available        bool                `json:"available"`
+	Overall          ShuffleShare        `json:"overall"`
+	ByMonth          []MonthShuffleShare `json:"by_month"`
+	InOrderArtists   []InOrderArtist     `json:"in_order_artists"`
+	InOrderAlbums    []InOrderAlbum      `json:"in_order_albums"`
+	SkipRateShuffled SkipRate            `json:"skip_rate_shuffled"`
+	SkipRateInOrder  SkipRate            `json:"skip_rate_in_order"`
+}
+
+type shuffleCounts struct {
+	name     string
+	artist   string
+	plays    int
+	shuffled int
+}
+
+func (c *shuffleCounts) share() ShuffleShare {
+	share := ShuffleShare{Plays: c.plays, Shuffled: c.shuffled}
+	if c.plays > 0 {
+		share.ShuffleShare = float64(c.shuffled) / float64(c.plays)
+	}
+
+	return share
+}
+
+func (c *shuffleCounts) add(other *shuffleCounts) {
+	if other.name != "" {
+		c.name = other.name
+	}
+	if other.artist != "" {
+		c.artist = other.artist
+	}
+	c.plays += other.plays
+	c.shuffled += other.shuffled
+}
+
+// shuffleAggregation is the shuffle side of an aggregation. Albums are keyed
+// by albumKey.
+type shuffleAggregation struct {
+	withShuffle int
+	overall     shuffleCounts
+
+	months  map[string]*shuffleCounts
+	artists map[string]*shuffleCounts
+	albums  map[string]*shuffleCounts
+
+	shuffledSkips skipCounts
+	inOrderSkips  skipCounts
+}
+
+func newShuffleAggregation() shuffleAggregation {
+	return shuffleAggregation{
+		months:  make(map[string]*shuffleCounts),
+		artists: make(map[string]*shuffleCounts),
+		albums:  make(map[string]*shuffleCounts),
+	}
+}
+
+func (s *shuffleAggregation) add(entry playEntry, albumKey string) {
+	track := entry.Track
+
+	// The basic export has no shuffle flag, and older extended entries
+	// often have it null. Those say nothing either way.
+	if track.Shuffle == nil {
+		return
+	}
+
+	shuffled := *track.Shuffle
+
+	s.withShuffle++
+
+	counts := []*shuffleCounts{&s.overall}
+
+	if entry.valid {
+		counts = append(counts, lookupShuffleCounts(s.months, entry.at.Format("2006-01")))
+	}
+
+	if artistName := track.MasterMetadataAlbumArtistName; artistName != "" {
+		artistCounts := lookupShuffleCounts(s.artists, artistName)
+		artistCounts.name = artistName
+		counts = append(counts, artistCounts)
+	}
+
+	if albumKey != "" {
+		albumCounts := lookupShuffleCounts(s.albums, albumKey)
+		albumCounts.name = track.MasterMetadataAlbumAlbumName
+		albumCounts.artist = track.MasterMetadataAlbumArtistName
+		counts = append(counts, albumCounts)
+	}
+
+	for _, c := range counts {
+		c.plays++
+		if shuffled {
+			c.shuffled++
+		}
+	}
+
+	skips := &s.inOrderSkips
+	if shuffled {
+		skips = &s.shuffledSkips
+	}
+
+	skips.plays++
+	if isSkip(track) {
+		skips.skips++
+	}
+}
+
+func lookupShuffleCounts(m map[string]*shuffleCounts, key string) *shuffleCounts {
+	counts, ok := m[key]
+	if !ok {
+		counts = &shuffleCounts{}
+		m[key] = counts
+	}
+
+	return counts
+}
+
+func (s *shuffleAggregation) merge(other *shuffleAggregation) {
+	s.withShuffle += other.withShuffle
+	s.overall.add(&other.overall)
+	s.shuffledSkips.add(&other.shuffledSkips)
+	s.inOrderSkips.add(&other.inOrderSkips)
+
+	for month, counts := range other.months {
+		lookupShuffleCounts(s.months, month).add(counts)
+	}
+
+	for artist, counts := range other.artists {
+		lookupShuffleCounts(s.artists, artist).add(counts)
+	}
+
+	for album, counts := range other.albums {
+		lookupShuffleCounts(s.albums, album).add(counts)
+	}
+}
+
+func mostlyInOrder(counts *shuffleCounts) bool {
+	return counts.plays >= minInOrderPlays && float64(counts.plays-counts.shuffled)/float64(counts.plays) >= mostlyInOrderRate
+}
+
+func getShuffleAnalysis(shuffle *shuffleAggregation) ShuffleAnalysis {
+	if shuffle.withShuffle == 0 {
+		return ShuffleAnalysis{}
+	}
+
+	byMonth := make([]MonthShuffleShare, 0, len(shuffle.months))
+	for month, counts := range shuffle.months {
+		byMonth = append(byMonth, MonthShuffleShare{Month: month, ShuffleShare: counts.share()})
+	}
+
+	sort.Slice(byMonth, func(i, j int) bool {
+		return byMonth[i].Month < byMonth[j].Month
+	})
+
+	artists := make([]InOrderArtist, 0)
+	for _, counts := range shuffle.artists {
+		if mostlyInOrder(counts) {
+			artists = append(artists, InOrderArtist{Artist: counts.name, ShuffleShare: counts.share()})
+		}
+	}
+
+	albums := make([]InOrderAlbum, 0)
+	for _, counts := range shuffle.albums {
+		if mostlyInOrder(counts) {
+			albums = append(albums, InOrderAlbum{Album: counts.name, Artist: counts.artist, ShuffleShare: counts.share()})
+		}
+	}
+
+	sort.Slice(artists, func(i, j int) bool {
+		return artists[i].Plays > artists[j].Plays
+	})
+
+	sort.Slice(albums, func(i, j int) bool {
+		return albums[i].Plays > albums[j].Plays
+	})
+
+	return ShuffleAnalysis{
+		Available:        true,
+		Overall:          shuffle.overall.share(),
+		ByMonth:          byMonth,
+		InOrderArtists:   artists[:min(25, len(artists))],
+		InOrderAlbums:    albums[:min(25, len(albums))],
+		SkipRateShuffled: shuffle.shuffledSkips.rate(),
+		SkipRateInOrder:  shuffle.inOrderSkips.rate(),
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShuffleSplit(t *testing.T) {
+	shuffled, inOrder := true, false
+
+	tests := []struct {
+		name          string
+		shuffle       []*bool
+		wantAvailable bool
+		wantPlays     int
+		wantShuffled  int
+	}{
+		{"all null", []*bool{nil, nil, nil, nil}, false, 0, 0},
+		{"all shuffled", []*bool{&shuffled, &shuffled}, true, 2, 2},
+		{"mixed", []*bool{&shuffled, &inOrder, &inOrder, nil}, true, 3, 1},
+	}
+
+	start := time.Date(2023, 1, 6, 12, 0, 0, 0, time.UTC)
+
+	for _, tt := range tests {
+		var tracks []Track
+		for i, shuffle := range tt.shuffle {
+			track := play(start.Add(time.Duration(i)*4*time.Minute), "Artist A", "Song", "Album", "spotify:track:1")
+			track.Shuffle = shuffle
+			tracks = append(tracks, track)
+		}
+
+		shuffle := analyzeTracks(t, tracks, AnalysisOptions{}).Shuffle
+
+		if shuffle.Available != tt.wantAvailable {
+			t.Errorf("%s: available = %v, want %v", tt.name, shuffle.Available, tt.wantAvailable)
+		}
+		if shuffle.Overall.Plays != tt.wantPlays || shuffle.Overall.Shuffled != tt.wantShuffled {
+			t.Errorf("%s: overall = %+v, want %d of %d plays shuffled", tt.name, shuffle.Overall, tt.wantShuffled, tt.wantPlays)
+		}
+	}
+}
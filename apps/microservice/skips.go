@@ -0,0 +1,266 @@
+package main
+
+import (
+	"sort"
+)
+
+const (
+	// A track needs at least this many plays before we'll say it's almost
+	// always finished.
+	minFinishedPlays = 10
+
+	// The share of plays that must end with the track finishing.
+	almostAlwaysFinishedRate = 0.9
+)
+
+type SkipRate struct {
+	Plays    int     `json:"plays"`
+	Skips    int     `json:"skips"`
+	SkipRate float64 `json:"skip_rate"`
+}
+
+type YearSkipRate struct {
+	Year int `json:"year"`
+	SkipRate
+}
+
+type SkippedTrack struct {
+	Track      string  `json:"track"`
+	Artist     string  `json:"artist"`
+	Uri        string  `json:"uri"`
+	Finished   int     `json:"finished"`
+	FinishRate float64 `json:"finish_rate"`
+	SkipRate
+}
+
+type SkippedArtist struct {
+	Artist string `json:"artist"`
+	SkipRate
+}
+
+// SkipAnalysis is how often music gets skipped or played to the end. It
+// looks at every music entry, whether or not the play policy counts it, since
+// the short plays are the skips. Available is false when the export has no
+// skip data at all, as with the basic format.
+type SkipAnalysis struct {
+	Available            bool            `json:"available"`
+	Overall              SkipRate        `json:"overall"`
+	ByYear               []YearSkipRate  `json:"by_year"`
+	MostSkippedTracks    []SkippedTrack  `json:"most_skipped_tracks"`
+	MostSkippedArtists   []SkippedArtist `json:"most_skipped_artists"`
+	AlmostAlwaysFinished []SkippedTrack  `json:"almost_always_finished"`
+	ReasonStart          map[string]int  `json:"reason_start"`
+	ReasonEnd            map[string]int  `json:"reason_end"`
+}
+
+// isSkip treats an entry as skipped if Spotify says so, or if it was ended
+// with the forward button. Older entries often have no skipped flag.
+func isSkip(track Track) bool {
+	return track.Skipped || track.ReasonEnd == "fwdbtn"
+}
+
+type skipCounts struct {
+	track    string
+	artist   string
+	plays    int
+	skips    int
+	finished int
+}
+
+func (c *skipCounts) rate() SkipRate {
+	rate := SkipRate{Plays: c.plays, Skips: c.skips}
+	if c.plays > 0 {
+		rate.SkipRate = float64(c.skips) / float64(c.plays)
+	}
+
+	return rate
+}
+
+// skipAggregation is the skip side of an aggregation. Tracks are keyed by
+// trackKey like everywhere else.
+type skipAggregation struct {
+	withReasons int
+	overall     skipCounts
+
+	years       map[int]*skipCounts
+	tracks      map[string]*skipCounts
+	artists     map[string]*skipCounts
+	reasonStart map[string]int
+	reasonEnd   map[string]int
+}
+
+func newSkipAggregation() skipAggregation {
+	return skipAggregation{
+		years:       make(map[int]*skipCounts),
+		tracks:      make(map[string]*skipCounts),
+		artists:     make(map[string]*skipCounts),
+		reasonStart: make(map[string]int),
+		reasonEnd:   make(map[string]int),
+	}
+}
+
+func (s *skipAggregation) add(entry playEntry, trackKey string) {
+	track := entry.Track
+
+	if track.ReasonStart != "" || track.ReasonEnd != "" {
+		s.withReasons++
+	}
+
+	if track.ReasonStart != "" {
+		s.reasonStart[track.ReasonStart]++
+	}
+	if track.ReasonEnd != "" {
+		s.reasonEnd[track.ReasonEnd]++
+	}
+
+	skipped := isSkip(track)
+	finished := track.ReasonEnd == "trackdone"
+
+	counts := []*skipCounts{&s.overall}
+
+	if entry.valid {
+		counts = append(counts, lookupSkipCounts(s.years, entry.at.Year()))
+	}
+
+	if track.MasterMetadataTrackName != "" {
+		trackCounts := lookupSkipCounts(s.tracks, trackKey)
+		trackCounts.track = displayTitle(trackCounts.track, track.MasterMetadataTrackName)
+		trackCounts.artist = track.MasterMetadataAlbumArtistName
+		counts = append(counts, trackCounts)
+	}
+
+	if artistName := track.MasterMetadataAlbumArtistName; artistName != "" {
+		artistCounts := lookupSkipCounts(s.artists, artistName)
+		artistCounts.artist = artistName
+		counts = append(counts, artistCounts)
+	}
+
+	for _, c := range counts {
+		c.plays++
+		if skipped {
+			c.skips++
+		}
+		if finished {
+			c.finished++
+		}
+	}
+}
+
+func lookupSkipCounts[K comparable](m map[K]*skipCounts, key K) *skipCounts {
+	counts, ok := m[key]
+	if !ok {
+		counts = &skipCounts{}
+		m[key] = counts
+	}
+
+	return counts
+}
+
+func (s *skipAggregation) merge(other *skipAggregation) {
+	s.withReasons += other.withReasons
+	s.overall.add(&other.overall)
+
+	for year, counts := range other.years {
+		lookupSkipCounts(s.years, year).add(counts)
+	}
+
+	for key, counts := range other.tracks {
+		lookupSkipCounts(s.tracks, key).add(counts)
+	}
+
+	for artist, counts := range other.artists {
+		lookupSkipCounts(s.artists, artist).add(counts)
+	}
+
+	for reason, count := range other.reasonStart {
+		s.reasonStart[reason] += count
+	}
+
+	for reason, count := range other.reasonEnd {
+		s.reasonEnd[reason] += count
+	}
+}
+
+func (c *skipCounts) add(other *skipCounts) {
+	c.track = displayTitle(c.track, other.track)
+	if other.artist != "" {
+		c.artist = other.artist
+	}
+	c.plays += other.plays
+	c.skips += other.skips
+	c.finished += other.finished
+}
+
+func getSkipAnalysis(skips *skipAggregation, trackUris uriCounts) SkipAnalysis {
+	if skips.withReasons == 0 {
+		return SkipAnalysis{}
+	}
+
+	byYear := make([]YearSkipRate, 0, len(skips.years))
+	for year, counts := range skips.years {
+		byYear = append(byYear, YearSkipRate{Year: year, SkipRate: counts.rate()})
+	}
+
+	sort.Slice(byYear, func(i, j int) bool {
+		return byYear[i].Year < byYear[j].Year
+	})
+
+	skippedTracks := make([]SkippedTrack, 0)
+	finishedTracks := make([]SkippedTrack, 0)
+
+	for key, counts := range skips.tracks {
+		track := SkippedTrack{
+			Track:    counts.track,
+			Artist:   counts.artist,
+			Uri:      trackUris.preferred(key),
+			Finished: counts.finished,
+			SkipRate: counts.rate(),
+		}
+
+		if counts.plays > 0 {
+			track.FinishRate = float64(counts.finished) / float64(counts.plays)
+		}
+
+		if counts.skips > 0 {
+			skippedTracks = append(skippedTracks, track)
+		}
+
+		if counts.plays >= minFinishedPlays && track.FinishRate >= almostAlwaysFinishedRate {
+			finishedTracks = append(finishedTracks, track)
+		}
+	}
+
+	skippedArtists := make([]SkippedArtist, 0)
+
+	for _, counts := range skips.artists {
+		if counts.skips > 0 {
+			skippedArtists = append(skippedArtists, SkippedArtist{
+				Artist:   counts.artist,
+				SkipRate: counts.rate(),
+			})
+		}
+	}
+
+	sort.Slice(skippedTracks, func(i, j int) bool {
+		return skippedTracks[i].Skips > skippedTracks[j].Skips
+	})
+
+	sort.Slice(skippedArtists, func(i, j int) bool {
+		return skippedArtists[i].Skips > skippedArtists[j].Skips
+	})
+
+	sort.Slice(finishedTracks, func(i, j int) bool {
+		return finishedTracks[i].Plays > finishedTracks[j].Plays
+	})
+
+	return SkipAnalysis{
+		Available:            true,
+		Overall:              skips.overall.rate(),
+		ByYear:               byYear,
+		MostSkippedTracks:    skippedTracks[:min(25, len(skippedTracks))],
+		MostSkippedArtists:   skippedArtists[:min(25, len(skippedArtists))],
+		AlmostAlwaysFinished: finishedTracks[:min(25, len(finishedTracks))],
+		ReasonStart:          skips.reasonStart,
+		ReasonEnd:            skips.reasonEnd,
+	}
+}
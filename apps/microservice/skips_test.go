@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSkipRate(t *testing.T) {
+	type ending struct {
+		reasonEnd string
+		skipped   bool
+	}
+
+	tests := []struct {
+		name          string
+		endings       []ending
+		wantAvailable bool
+		wantSkips     int
+		wantEnds      map[string]int
+	}{
+		{
+			"no reasons",
+			[]ending{{"", false}, {"", false}},
+			false, 0, nil,
+		},
+		{
+			"forward button counts without the flag",
+			[]ending{{"trackdone", false}, {"fwdbtn", false}, {"fwdbtn", false}, {"endplay", false}},
+			true, 2, map[string]int{"trackdone": 1, "fwdbtn": 2, "endplay": 1},
+		},
+		{
+			"skipped flag counts whatever the reason",
+			[]ending{{"trackdone", false}, {"endplay", true}, {"fwdbtn", true}, {"trackdone", false}},
+			true, 2, map[string]int{"trackdone": 2, "endplay": 1, "fwdbtn": 1},
+		},
+	}
+
+	start := time.Date(2023, 1, 6, 12, 0, 0, 0, time.UTC)
+
+	for _, tt := range tests {
+		var tracks []Track
+		for i, end := range tt.endings {
+			track := play(start.Add(time.Duration(i)*4*time.Minute), "Artist A", "Song", "Album", "spotify:track:1")
+			track.ReasonEnd = end.reasonEnd
+			track.Skipped = end.skipped
+			tracks = append(tracks, track)
+		}
+
+		skips := analyzeTracks(t, tracks, AnalysisOptions{}).Skips
+
+		if skips.Available != tt.wantAvailable {
+			t.Errorf("%s: available = %v, want %v", tt.name, skips.Available, tt.wantAvailable)
+		}
+		if !tt.wantAvailable {
+			continue
+		}
+
+		wantRate := float64(tt.wantSkips) / float64(len(tt.endings))
+		if skips.Overall.Plays != len(tt.endings) || skips.Overall.Skips != tt.wantSkips || skips.Overall.SkipRate != wantRate {
+			t.Errorf("%s: overall = %+v, want %d of %d skipped", tt.name, skips.Overall, tt.wantSkips, len(tt.endings))
+		}
+
+		if len(skips.ReasonEnd) != len(tt.wantEnds) {
+			t.Errorf("%s: reason_end = %v, want %v", tt.name, skips.ReasonEnd, tt.wantEnds)
+		}
+		for reason, count := range tt.wantEnds {
+			if skips.ReasonEnd[reason] != count {
+				t.Errorf("%s: reason_end = %v, want %v", tt.name, skips.ReasonEnd, tt.wantEnds)
+			}
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type JobStatus string
+
+const (
+	StatusQueued      JobStatus = "queued"
+	StatusDownloading JobStatus = "downloading"
+	StatusExtracting  JobStatus = "extracting"
+	StatusParsing     JobStatus = "parsing"
+	StatusAnalyzing   JobStatus = "analyzing"
+	StatusUploading   JobStatus = "uploading"
+	StatusNotifying   JobStatus = "notifying"
+	StatusCompleted   JobStatus = "completed"
+	StatusFailed      JobStatus = "failed"
+	StatusCancelled   JobStatus = "cancelled"
+)
+
+// How long finished jobs stay visible through the status endpoint.
+const statusRetention = 24 * time.Hour
+
+func (s JobStatus) Terminal() bool {
+	return s == StatusCompleted || s == StatusFailed || s == StatusCancelled
+}
+
+type StatusChange struct {
+	Status JobStatus `json:"status"`
+	At     time.Time `json:"at"`
+}
+
+type JobState struct {
+	ProcessID  string         `json:"process_id"`
+	UserID     string         `json:"user_id"`
+	Status     JobStatus      `json:"status"`
+	WorkerID   *int           `json:"worker_id,omitempty"`
+	Attempts   int            `json:"attempts"`
+	Error      string         `json:"error,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+	StartedAt  *time.Time     `json:"started_at,omitempty"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+	History    []StatusChange `json:"history"`
+
+	// job is the submission this state tracks. A cancelled job can be
+	// submitted again while the old one is still queued or winding down,
+	// and that one must not touch the new state.
+	job *Job
+}
+
+// StatusTracker keeps the lifecycle of every job the service has seen
+// recently so it can be reported through GET /jobs/:processId.
+type StatusTracker struct {
+	mu    sync.RWMutex
+	jobs  map[string]*JobState
+	keys  map[string]string // idempotency key -> process id
+	store *StatusStore
+}
+
+// NewStatusTracker returns a tracker that keeps finished jobs in store, if
+// there is one, so they survive a restart. Call Load to read them back.
+func NewStatusTracker(store *StatusStore) *StatusTracker {
+	return &StatusTracker{
+		jobs:  make(map[string]*JobState),
+		keys:  make(map[string]string),
+		store: store,
+	}
+}
+
+// Load reads back the finished jobs kept in the store. Unfinished jobs are
+// in the JobStore and are registered again with Queued when they resume.
+func (t *StatusTracker) Load() error {
+	if t.store == nil {
+		return nil
+	}
+
+	states, err := t.store.List()
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, stored := range states {
+		state := stored.JobState
+		t.jobs[state.ProcessID] = &state
+
+		if stored.IdempotencyKey != "" {
+			t.keys[stored.IdempotencyKey] = state.ProcessID
+		}
+	}
+
+	t.prune()
+
+	return nil
+}
+
+func (t *StatusTracker) Queued(job *Job) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune()
+	t.queue(job)
+}
+
+// Admit registers a newly submitted job, unless a job with the same process
+// id or idempotency key is already queued, running or recently completed.
+// In that case it returns the existing job's state and false. Failed and
+// cancelled jobs can always be submitted again.
+func (t *StatusTracker) Admit(job *Job) (JobState, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune()
+
+	if existing := t.duplicateOf(job); existing != nil {
+		return copyState(existing), false
+	}
+
+	t.queue(job)
+
+	return JobState{}, true
+}
+
+// Duplicate returns the state of a job Admit would turn job away for,
+// without registering job.
+func (t *StatusTracker) Duplicate(job *Job) (JobState, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune()
+
+	if existing := t.duplicateOf(job); existing != nil {
+		return copyState(existing), true
+	}
+
+	return JobState{}, false
+}
+
+func (t *StatusTracker) duplicateOf(job *Job) *JobState {
+	ids := []string{job.ProcessID}
+
+	if job.IdempotencyKey != "" {
+		if id, ok := t.keys[job.IdempotencyKey]; ok {
+			ids = append(ids, id)
+		}
+	}
+
+	for _, id := range ids {
+		if state, ok := t.jobs[id]; ok && state.Status != StatusFailed && state.Status != StatusCancelled {
+			return state
+		}
+	}
+
+	return nil
+}
+
+func (t *StatusTracker) queue(job *Job) {
+	now := time.Now()
+
+	if job.IdempotencyKey != "" {
+		t.keys[job.IdempotencyKey] = job.ProcessID
+	}
+
+	t.jobs[job.ProcessID] = &JobState{
+		ProcessID: job.ProcessID,
+		UserID:    job.UserID,
+		Status:    StatusQueued,
+		Attempts:  job.Attempts,
+		CreatedAt: job.EnqueuedAt,
+		UpdatedAt: now,
+		History:   []StatusChange{{Status: StatusQueued, At: now}},
+		job:       job,
+	}
+}
+
+func (t *StatusTracker) Started(job *Job, workerID int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.superseded(job) {
+		return
+	}
+
+	state := t.state(job)
+	now := time.Now()
+
+	state.WorkerID = &workerID
+	state.Attempts = job.Attempts
+	state.StartedAt = &now
+	state.FinishedAt = nil
+	state.Error = ""
+}
+
+func (t *StatusTracker) Update(job *Job, status JobStatus) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// A cancelled job may still report progress until its worker notices.
+	if state, ok := t.jobs[job.ProcessID]; ok && state.job == job && !state.Status.Terminal() {
+		t.transition(state, status)
+	}
+}
+
+// Cancel marks a job as cancelled and returns its new state.
+func (t *StatusTracker) Cancel(processID string) JobState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.jobs[processID]
+	if !ok {
+		return JobState{}
+	}
+
+	t.transition(state, StatusCancelled)
+
+	return copyState(state)
+}
+
+// Fail marks a job as failed and returns the stage it was in when it did.
+func (t *StatusTracker) Fail(job *Job, err error) JobStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.jobs[job.ProcessID]
+	if !ok || state.job != job {
+		return StatusQueued
+	}
+
+	stage := state.Status
+	state.Error = err.Error()
+	t.transition(state, StatusFailed)
+
+	return stage
+}
+
+// Forget drops a job the queue ended up not accepting.
+func (t *StatusTracker) Forget(processID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.jobs, processID)
+
+	for key, id := range t.keys {
+		if id == processID {
+			delete(t.keys, key)
+		}
+	}
+}
+
+// Superseded reports whether job was cancelled and its process id has been
+// submitted again since. Whatever is left of job must then leave the new
+// submission alone.
+func (t *StatusTracker) Superseded(job *Job) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.superseded(job)
+}
+
+func (t *StatusTracker) superseded(job *Job) bool {
+	state, ok := t.jobs[job.ProcessID]
+	return ok && state.job != job
+}
+
+// Get returns a copy of the job's state, safe to hand out to callers.
+func (t *StatusTracker) Get(processID string) (JobState, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	state, ok := t.jobs[processID]
+	if !ok {
+		return JobState{}, false
+	}
+
+	return copyState(state), true
+}
+
+func copyState(state *JobState) JobState {
+	copied := *state
+	copied.History = append([]StatusChange(nil), state.History...)
+
+	return copied
+}
+
+// Running returns the ids of jobs a worker has picked up but not finished.
+func (t *StatusTracker) Running() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var running []string
+	for id, state := range t.jobs {
+		if state.StartedAt != nil && !state.Status.Terminal() {
+			running = append(running, id)
+		}
+	}
+
+	return running
+}
+
+func (t *StatusTracker) transition(state *JobState, status JobStatus) {
+	now := time.Now()
+
+	state.Status = status
+	state.UpdatedAt = now
+	state.History = append(state.History, StatusChange{Status: status, At: now})
+
+	if status.Terminal() {
+		state.FinishedAt = &now
+		t.save(state)
+	}
+}
+
+// save keeps a finished job's state in the store. Callers must hold the
+// write lock.
+func (t *StatusTracker) save(state *JobState) {
+	if t.store == nil {
+		return
+	}
+
+	var key string
+	if state.job != nil {
+		key = state.job.IdempotencyKey
+	}
+
+	if err := t.store.Save(state, key); err != nil {
+		log.Printf("Failed to save status of job %s: %v", state.ProcessID, err)
+	}
+}
+
+// state returns the tracked state for a job, creating it if the tracker has
+// not seen the job yet.
+func (t *StatusTracker) state(job *Job) *JobState {
+	state, ok := t.jobs[job.ProcessID]
+	if !ok {
+		state = &JobState{
+			ProcessID: job.ProcessID,
+			UserID:    job.UserID,
+			Status:    StatusQueued,
+			CreatedAt: job.EnqueuedAt,
+			UpdatedAt: time.Now(),
+			job:       job,
+		}
+		t.jobs[job.ProcessID] = state
+	}
+
+	return state
+}
+
+// prune drops finished jobs older than statusRetention. Callers must hold
+// the write lock.
+func (t *StatusTracker) prune() {
+	cutoff := time.Now().Add(-statusRetention)
+
+	for id, state := range t.jobs {
+		if state.Status.Terminal() && state.UpdatedAt.Before(cutoff) {
+			delete(t.jobs, id)
+
+			if t.store != nil {
+				if err := t.store.Remove(id); err != nil {
+					log.Printf("Failed to remove status of job %s: %v", id, err)
+				}
+			}
+		}
+	}
+
+	for key, id := range t.keys {
+		if _, ok := t.jobs[id]; !ok {
+			delete(t.keys, key)
+		}
+	}
+}
+
+// StatusStore keeps the state of finished jobs on disk, one JSON file per
+// job, so GET /jobs/:processId still answers for them and they are still
+// deduplicated after a restart.
+type StatusStore struct {
+	dir string
+}
+
+// storedState is a finished job's state along with the idempotency key it
+// was submitted with.
+type storedState struct {
+	JobState
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+func NewStatusStore(dir string) (*StatusStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create status directory: %w", err)
+	}
+
+	return &StatusStore{dir: dir}, nil
+}
+
+func (s *StatusStore) Save(state *JobState, idempotencyKey string) error {
+	data, err := json.Marshal(storedState{JobState: *state, IdempotencyKey: idempotencyKey})
+	if err != nil {
+		return fmt.Errorf("error marshaling job status: %w", err)
+	}
+
+	return writeFileAtomic(s.dir, s.path(state.ProcessID), data)
+}
+
+func (s *StatusStore) Remove(processID string) error {
+	err := os.Remove(s.path(processID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *StatusStore) List() ([]storedState, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read status directory: %w", err)
+	}
+
+	var states []storedState
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+
+		path := filepath.Join(s.dir, file.Name())
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading status file: %w", err)
+		}
+
+		var state storedState
+		if err := json.Unmarshal(data, &state); err != nil {
+			log.Printf("Skipping unreadable status file %s: %v", path, err)
+			continue
+		}
+
+		states = append(states, state)
+	}
+
+	return states, nil
+}
+
+func (s *StatusStore) path(processID string) string {
+	return filepath.Join(s.dir, fileKey(processID)+".json")
+}
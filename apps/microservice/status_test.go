@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func statuses(state JobState) []JobStatus {
+	var history []JobStatus
+	for _, change := range state.History {
+		history = append(history, change.Status)
+	}
+	return history
+}
+
+func TestStatusTransitions(t *testing.T) {
+	tracker := NewStatusTracker(nil)
+	job := &Job{ProcessID: "p1", UserID: "u1", IdempotencyKey: "k1", EnqueuedAt: time.Now()}
+
+	if _, ok := tracker.Admit(job); !ok {
+		t.Fatal("new job was not admitted")
+	}
+
+	job.Attempts = 1
+	tracker.Started(job, 3)
+	for _, status := range []JobStatus{StatusDownloading, StatusExtracting, StatusParsing, StatusAnalyzing, StatusUploading, StatusNotifying, StatusCompleted} {
+		tracker.Update(job, status)
+	}
+
+	// Nothing moves a job on once it is finished.
+	tracker.Update(job, StatusParsing)
+
+	state, ok := tracker.Get("p1")
+	if !ok {
+		t.Fatal("job is not tracked")
+	}
+
+	want := []JobStatus{StatusQueued, StatusDownloading, StatusExtracting, StatusParsing, StatusAnalyzing, StatusUploading, StatusNotifying, StatusCompleted}
+	if !slices.Equal(statuses(state), want) {
+		t.Fatalf("history = %v, want %v", statuses(state), want)
+	}
+	if state.Status != StatusCompleted || state.WorkerID == nil || *state.WorkerID != 3 || state.Attempts != 1 {
+		t.Fatalf("state = %+v, want completed by worker 3 on attempt 1", state)
+	}
+	if state.StartedAt == nil || state.FinishedAt == nil {
+		t.Fatalf("started at %v, finished at %v, want both set", state.StartedAt, state.FinishedAt)
+	}
+
+	if _, dup := tracker.Duplicate(&Job{ProcessID: "p2", IdempotencyKey: "k1"}); !dup {
+		t.Fatal("a completed job's idempotency key was not deduplicated")
+	}
+
+	failed := &Job{ProcessID: "p3", UserID: "u1", EnqueuedAt: time.Now()}
+	tracker.Admit(failed)
+	tracker.Started(failed, 0)
+	tracker.Update(failed, StatusParsing)
+
+	if stage := tracker.Fail(failed, errors.New("broken export")); stage != StatusParsing {
+		t.Fatalf("failed while %s, want %s", stage, StatusParsing)
+	}
+
+	state, _ = tracker.Get("p3")
+	if state.Status != StatusFailed || state.Error != "broken export" {
+		t.Fatalf("state = %+v, want failed with the error", state)
+	}
+
+	if _, ok := tracker.Admit(&Job{ProcessID: "p3", UserID: "u1", EnqueuedAt: time.Now()}); !ok {
+		t.Fatal("failed job could not be submitted again")
+	}
+}
+
+func TestFinishedJobsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewStatusStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := NewStatusTracker(store)
+	job := &Job{ProcessID: "p1", UserID: "u1", IdempotencyKey: "k1", EnqueuedAt: time.Now()}
+	tracker.Admit(job)
+	tracker.Started(job, 0)
+	tracker.Update(job, StatusCompleted)
+
+	// A job older than the retention is dropped when loaded.
+	old := time.Now().Add(-statusRetention - time.Hour)
+	if err := store.Save(&JobState{ProcessID: "old", Status: StatusCompleted, UpdatedAt: old}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unfinished jobs are only kept in the JobStore.
+	tracker.Admit(&Job{ProcessID: "p2", UserID: "u1", EnqueuedAt: time.Now()})
+
+	restarted := NewStatusTracker(store)
+	if err := restarted.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	state, ok := restarted.Get("p1")
+	if !ok || state.Status != StatusCompleted || len(state.History) != 2 {
+		t.Fatalf("p1 after restart = %+v (tracked %v), want it completed", state, ok)
+	}
+
+	if existing, dup := restarted.Duplicate(&Job{ProcessID: "p9", IdempotencyKey: "k1"}); !dup || existing.ProcessID != "p1" {
+		t.Fatal("idempotency key of a completed job was forgotten on restart")
+	}
+
+	for _, id := range []string{"old", "p2"} {
+		if _, ok := restarted.Get(id); ok {
+			t.Errorf("%s is tracked after restart", id)
+		}
+	}
+
+	if _, err := os.Stat(store.path("old")); !os.IsNotExist(err) {
+		t.Fatalf("expired status file was kept: %v", err)
+	}
+}
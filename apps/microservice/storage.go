@@ -1,23 +1,134 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"log"
 	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
-func DownloadFromS3(client *s3.Client, bucketName, s3Key, destPath string) error {
-	result, err := client.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(s3Key),
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore is where uploaded exports are read from and results are written
+// to. Keys are slash separated paths like "data-transfers/<id>.json.gz".
+type BlobStore interface {
+	// Get opens the blob at key. size is -1 if the store doesn't know it up
+	// front. A missing blob is an ErrBlobNotFound.
+	Get(ctx context.Context, key string) (body io.ReadCloser, size int64, err error)
+
+	// Put stores everything read from body at key, replacing what was there.
+	Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error
+}
+
+// PutOptions describe a blob being stored. Stores that have nowhere to keep
+// them ignore them.
+type PutOptions struct {
+	ContentType string
+	Metadata    map[string]string
+}
+
+// Storage backends selectable with STORAGE_BACKEND.
+const (
+	StorageS3     = "s3"
+	StorageLocal  = "local"
+	StorageMemory = "memory"
+)
+
+// blobStoreFromEnv opens the backend named by STORAGE_BACKEND, S3 unless
+// told otherwise.
+func blobStoreFromEnv(ctx context.Context) (BlobStore, error) {
+	switch backend := envString("STORAGE_BACKEND", StorageS3); backend {
+	case StorageS3:
+		return s3BlobStoreFromEnv(ctx)
+	case StorageLocal:
+		return NewLocalBlobStore(envString("STORAGE_DIR", "data/blobs"))
+	case StorageMemory:
+		log.Println("WARNING: STORAGE_BACKEND=memory keeps every export and result in memory and loses them on restart. Do not use it in production.")
+		return NewMemoryBlobStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+// s3BlobStoreFromEnv connects to S3 or an S3 compatible store like MinIO or
+// R2. Static keys are used when both are set, otherwise the SDK's default
+// credential chain.
+func s3BlobStoreFromEnv(ctx context.Context) (BlobStore, error) {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	sessionToken := os.Getenv("AWS_SESSION_TOKEN")
+	bucketName := os.Getenv("S3_BUCKET_NAME")
+	region := os.Getenv("AWS_REGION")
+	endpoint := os.Getenv("S3_ENDPOINT_URL")
+	usePathStyle := envBool("S3_FORCE_PATH_STYLE", false)
+
+	if bucketName == "" {
+		return nil, errors.New("S3_BUCKET_NAME must be set")
+	}
+
+	var opts []func(*config.LoadOptions) error
+
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+
+	if accessKey != "" && secretKey != "" {
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			accessKey,
+			secretKey,
+			sessionToken,
+		)))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load SDK config: %w", err)
+	}
+
+	if cfg.Region == "" {
+		return nil, errors.New("AWS region must be set, with AWS_REGION or in the shared config")
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+		o.UsePathStyle = usePathStyle
 	})
+
+	log.Printf("Using S3 bucket %s in %s", bucketName, cfg.Region)
+
+	return NewS3BlobStore(client, bucketName), nil
+}
+
+// DownloadBlob saves a blob to destPath. With a budget, blobs larger than
+// the job's archive limit are rejected before and while downloading, and
+// what is written is charged as disk usage. A failed download gives its
+// bytes back, since the next attempt overwrites the file.
+func DownloadBlob(ctx context.Context, store BlobStore, key, destPath string, budget *JobBudget) error {
+	body, size, err := store.Get(ctx, key)
 	if err != nil {
 		return err
 	}
-	defer result.Body.Close()
+	defer body.Close()
+
+	if size >= 0 {
+		if err := budget.CheckArchive(size); err != nil {
+			return err
+		}
+	}
 
 	destFile, err := os.Create(destPath)
 	if err != nil {
@@ -25,6 +136,185 @@ func DownloadFromS3(client *s3.Client, bucketName, s3Key, destPath string) error
 	}
 	defer destFile.Close()
 
-	_, err = io.Copy(destFile, result.Body)
+	var written int64
+	_, err = io.Copy(&budgetWriter{w: destFile, charge: func(n int64) error {
+		if err := budget.CheckArchive(written + n); err != nil {
+			return err
+		}
+		written += n
+		return budget.AddDisk(n)
+	}}, body)
+
+	if err != nil {
+		budget.AddDisk(-written)
+	}
+
+	return err
+}
+
+// S3BlobStore keeps blobs in an S3 bucket. Puts go through the upload
+// manager, which sends bodies of unknown length as multipart uploads part by
+// part instead of buffering them.
+type S3BlobStore struct {
+	client   *s3.Client
+	uploader *manager.Uploader
+	bucket   string
+}
+
+func NewS3BlobStore(client *s3.Client, bucket string) *S3BlobStore {
+	return &S3BlobStore{
+		client:   client,
+		uploader: manager.NewUploader(client),
+		bucket:   bucket,
+	}
+}
+
+func (s *S3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	result, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, 0, fmt.Errorf("%w: %w", ErrBlobNotFound, err)
+		}
+		return nil, 0, err
+	}
+
+	size := int64(-1)
+	if result.ContentLength != nil {
+		size = *result.ContentLength
+	}
+
+	return result.Body, size, nil
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	input := &s3.PutObjectInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		Body:     body,
+		Metadata: opts.Metadata,
+	}
+
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+
+	_, err := s.uploader.Upload(ctx, input)
+
 	return err
 }
+
+// LocalBlobStore keeps blobs as files under a directory, for local
+// development. Content types and metadata aren't kept.
+type LocalBlobStore struct {
+	dir string
+}
+
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &LocalBlobStore{dir: dir}, nil
+}
+
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if err := checkEntryName(key); err != nil || key == "" {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+func (s *LocalBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, 0, Permanent(err)
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, fmt.Errorf("%w: %s", ErrBlobNotFound, key)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	return file, info.Size(), nil
+}
+
+func (s *LocalBlobStore) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	path, err := s.path(key)
+	if err != nil {
+		return Permanent(err)
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, &contextReader{ctx: ctx, r: body}); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// MemoryBlobStore keeps blobs in memory, so the pipeline can run in tests
+// or a quick local try without S3 or a directory to clean up. Everything is
+// lost on restart. Like LocalBlobStore it doesn't keep content types or
+// metadata.
+type MemoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+}
+
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{blobs: make(map[string][]byte)}
+}
+
+func (s *MemoryBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	s.mu.RLock()
+	data, ok := s.blobs[key]
+	s.mu.RUnlock()
+
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: %s", ErrBlobNotFound, key)
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+func (s *MemoryBlobStore) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	data, err := io.ReadAll(&contextReader{ctx: ctx, r: body})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.blobs[key] = data
+	s.mu.Unlock()
+
+	return nil
+}
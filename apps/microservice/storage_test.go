@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlobStoresRoundTrip(t *testing.T) {
+	local, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := map[string]BlobStore{
+		"local":  local,
+		"memory": NewMemoryBlobStore(),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			if err := store.Put(ctx, "data-transfers/p1.json.gz", strings.NewReader("result"), PutOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			body, size, err := store.Get(ctx, "data-transfers/p1.json.gz")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := io.ReadAll(body)
+			body.Close()
+
+			if string(data) != "result" || size != int64(len(data)) {
+				t.Fatalf("got %q (%d bytes), want %q", data, size, "result")
+			}
+
+			if _, _, err := store.Get(ctx, "data-transfers/missing.json.gz"); !errors.Is(err, ErrBlobNotFound) {
+				t.Fatalf("missing blob = %v, want ErrBlobNotFound", err)
+			}
+		})
+	}
+}
+
+func TestBlobStoreFromEnv(t *testing.T) {
+	t.Setenv("STORAGE_DIR", t.TempDir())
+
+	t.Setenv("STORAGE_BACKEND", StorageMemory)
+	if store, err := blobStoreFromEnv(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if _, ok := store.(*MemoryBlobStore); !ok {
+		t.Fatalf("memory backend = %T, want *MemoryBlobStore", store)
+	}
+
+	t.Setenv("STORAGE_BACKEND", StorageLocal)
+	if store, err := blobStoreFromEnv(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if _, ok := store.(*LocalBlobStore); !ok {
+		t.Fatalf("local backend = %T, want *LocalBlobStore", store)
+	}
+
+	t.Setenv("STORAGE_BACKEND", "ftp")
+	if _, err := blobStoreFromEnv(context.Background()); err == nil {
+		t.Fatal("unknown backend was accepted")
+	}
+}
+
+func TestLocalBlobStoreRejectsKeysOutsideItsDirectory(t *testing.T) {
+	store, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Put(context.Background(), "../escape", strings.NewReader("x"), PutOptions{}); err == nil {
+		t.Fatal("key outside the directory was accepted")
+	}
+}
+
+func TestQueueEndToEnd(t *testing.T) {
+	stub := newMainAppStub(t)
+	dir := t.TempDir()
+
+	store, err := NewFileJobStore(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := NewMemoryBlobStore()
+	if err := blobs.Put(context.Background(), "exports/p1.zip", bytes.NewReader(testExportBytes(t, testTracks(500))), PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	q := newTestQueue(t, dir, blobs, store)
+	q.Start()
+	defer stopQueue(t, q, 5*time.Second)
+
+	if _, err := q.AddJob(&Job{S3Key: "exports/p1.zip", ProcessID: "p1", UserID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "result callback", func() bool {
+		return len(stub.received()) > 0
+	})
+
+	callbacks := stub.received()
+	if len(callbacks) != 1 || callbacks[0].ProcessID != "p1" || !callbacks[0].Body.Success {
+		t.Fatalf("callbacks = %+v, want one result for p1", callbacks)
+	}
+
+	body, _, err := blobs.Get(context.Background(), callbacks[0].Body.S3Key)
+	if err != nil {
+		t.Fatalf("result blob: %v", err)
+	}
+	defer body.Close()
+
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result ProcessResult
+	if err := json.NewDecoder(gz).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	if result.ProcessID != "p1" || result.TotalTracks != 500 {
+		t.Fatalf("result is for %s with %d tracks, want p1 with 500", result.ProcessID, result.TotalTracks)
+	}
+
+	if _, err := q.AddJob(&Job{S3Key: "exports/missing.zip", ProcessID: "p2", UserID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "failure callback", func() bool {
+		return len(stub.received()) > 1
+	})
+
+	if failure := stub.received()[1]; failure.ProcessID != "p2" || failure.Body.ErrorCode != ErrCodeDownloadFailed {
+		t.Fatalf("callback = %+v, want %s for p2", failure, ErrCodeDownloadFailed)
+	}
+}
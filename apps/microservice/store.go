@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// JobStore persists queued jobs so they survive restarts. A job is saved
+// before it is handed to a worker and only removed once the worker is done
+// with it, so anything still in the store at startup gets processed again
+// (at-least-once).
+type JobStore interface {
+	Save(job *Job) error
+	Remove(processID string) error
+	Pending() ([]*Job, error)
+}
+
+// FileJobStore keeps one JSON file per job in a directory on disk.
+type FileJobStore struct {
+	dir string
+}
+
+func NewFileJobStore(dir string) (*FileJobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+
+	return &FileJobStore{dir: dir}, nil
+}
+
+func (s *FileJobStore) Save(job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("error marshaling job: %w", err)
+	}
+
+	return writeFileAtomic(s.dir, s.path(job.ProcessID), data)
+}
+
+func (s *FileJobStore) Remove(processID string) error {
+	err := os.Remove(s.path(processID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *FileJobStore) Pending() ([]*Job, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue directory: %w", err)
+	}
+
+	var jobs []*Job
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+
+		path := filepath.Join(s.dir, file.Name())
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading job file: %w", err)
+		}
+
+		job := new(Job)
+		if err := json.Unmarshal(data, job); err != nil {
+			log.Printf("Skipping unreadable job file %s: %v", path, err)
+			continue
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].EnqueuedAt.Before(jobs[j].EnqueuedAt)
+	})
+
+	return jobs, nil
+}
+
+func (s *FileJobStore) path(processID string) string {
+	return filepath.Join(s.dir, fileKey(processID)+".json")
+}
+
+// fileKey turns an arbitrary id into a name that is safe to use on disk.
+func fileKey(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeFileAtomic writes data to a temp file in dir, syncs it and renames it
+// over path, so a crash never leaves a half-written file behind.
+func writeFileAtomic(dir, path string, data []byte) error {
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	// The runtime image has no zoneinfo, so embed it.
+	_ "time/tzdata"
+)
+
+// countryZones maps a ConnCountry code to the zones used in that country,
+// most populous first. It only needs to be good enough to put a play in the
+// right part of the day while someone is travelling.
+var countryZones = map[string][]string{
+	"AE": {"Asia/Dubai"},
+	"AR": {"America/Argentina/Buenos_Aires"},
+	"AT": {"Europe/Vienna"},
+	"AU": {"Australia/Sydney", "Australia/Melbourne", "Australia/Brisbane", "Australia/Perth", "Australia/Adelaide", "Australia/Hobart", "Australia/Darwin"},
+	"BE": {"Europe/Brussels"},
+	"BG": {"Europe/Sofia"},
+	"BR": {"America/Sao_Paulo", "America/Manaus", "America/Fortaleza", "America/Recife", "America/Belem", "America/Cuiaba", "America/Rio_Branco", "America/Noronha"},
+	"CA": {"America/Toronto", "America/Vancouver", "America/Edmonton", "America/Winnipeg", "America/Halifax", "America/Regina", "America/St_Johns"},
+	"CH": {"Europe/Zurich"},
+	"CL": {"America/Santiago"},
+	"CO": {"America/Bogota"},
+	"CR": {"America/Costa_Rica"},
+	"CY": {"Asia/Nicosia"},
+	"CZ": {"Europe/Prague"},
+	"DE": {"Europe/Berlin"},
+	"DK": {"Europe/Copenhagen"},
+	"DO": {"America/Santo_Domingo"},
+	"EC": {"America/Guayaquil"},
+	"EE": {"Europe/Tallinn"},
+	"EG": {"Africa/Cairo"},
+	"ES": {"Europe/Madrid", "Atlantic/Canary"},
+	"FI": {"Europe/Helsinki"},
+	"FR": {"Europe/Paris"},
+	"GB": {"Europe/London"},
+	"GR": {"Europe/Athens"},
+	"GT": {"America/Guatemala"},
+	"HK": {"Asia/Hong_Kong"},
+	"HR": {"Europe/Zagreb"},
+	"HU": {"Europe/Budapest"},
+	"ID": {"Asia/Jakarta", "Asia/Makassar", "Asia/Jayapura"},
+	"IE": {"Europe/Dublin"},
+	"IL": {"Asia/Jerusalem"},
+	"IN": {"Asia/Kolkata"},
+	"IS": {"Atlantic/Reykjavik"},
+	"IT": {"Europe/Rome"},
+	"JP": {"Asia/Tokyo"},
+	"KE": {"Africa/Nairobi"},
+	"KR": {"Asia/Seoul"},
+	"LT": {"Europe/Vilnius"},
+	"LU": {"Europe/Luxembourg"},
+	"LV": {"Europe/Riga"},
+	"MA": {"Africa/Casablanca"},
+	"MT": {"Europe/Malta"},
+	"MX": {"America/Mexico_City", "America/Monterrey", "America/Tijuana", "America/Hermosillo", "America/Cancun", "America/Chihuahua", "America/Mazatlan"},
+	"MY": {"Asia/Kuala_Lumpur"},
+	"NG": {"Africa/Lagos"},
+	"NL": {"Europe/Amsterdam"},
+	"NO": {"Europe/Oslo"},
+	"NZ": {"Pacific/Auckland"},
+	"PA": {"America/Panama"},
+	"PE": {"America/Lima"},
+	"PH": {"Asia/Manila"},
+	"PK": {"Asia/Karachi"},
+	"PL": {"Europe/Warsaw"},
+	"PT": {"Europe/Lisbon", "Atlantic/Azores"},
+	"PY": {"America/Asuncion"},
+	"RO": {"Europe/Bucharest"},
+	"RS": {"Europe/Belgrade"},
+	"SA": {"Asia/Riyadh"},
+	"SE": {"Europe/Stockholm"},
+	"SG": {"Asia/Singapore"},
+	"SI": {"Europe/Ljubljana"},
+	"SK": {"Europe/Bratislava"},
+	"TH": {"Asia/Bangkok"},
+	"TR": {"Europe/Istanbul"},
+	"TW": {"Asia/Taipei"},
+	"UA": {"Europe/Kyiv"},
+	"US": {"America/New_York", "America/Chicago", "America/Los_Angeles", "America/Denver", "America/Phoenix", "America/Anchorage", "Pacific/Honolulu", "America/Detroit", "America/Boise", "America/Indiana/Indianapolis"},
+	"UY": {"America/Montevideo"},
+	"VN": {"Asia/Ho_Chi_Minh"},
+	"ZA": {"Africa/Johannesburg"},
+}
+
+// zoneResolver picks the zone each play is bucketed in: the user's zone, or
+// with inference on, the zone of the country the play was streamed from.
+// It is only used from the decoding goroutine.
+type zoneResolver struct {
+	home     *time.Location
+	homeName string
+	infer    bool
+	zones    map[string]*time.Location
+}
+
+func newZoneResolver(options AnalysisOptions) (*zoneResolver, error) {
+	home := time.UTC
+
+	if options.Timezone != "" {
+		loc, err := time.LoadLocation(options.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown timezone %q: %w", options.Timezone, err)
+		}
+		home = loc
+	}
+
+	return &zoneResolver{
+		home:     home,
+		homeName: options.Timezone,
+		infer:    options.InferTimezone,
+		zones:    make(map[string]*time.Location),
+	}, nil
+}
+
+// locate returns the zone for a play streamed from country. In a country
+// with several zones the user's own zone wins if it is one of them, so
+// inference doesn't move people around their own country.
+func (r *zoneResolver) locate(country string) *time.Location {
+	if !r.infer {
+		return r.home
+	}
+
+	candidates, ok := countryZones[country]
+	if !ok || slices.Contains(candidates, r.homeName) {
+		return r.home
+	}
+
+	loc, ok := r.zones[country]
+	if !ok {
+		var err error
+		loc, err = time.LoadLocation(candidates[0])
+		if err != nil {
+			loc = r.home
+		}
+		r.zones[country] = loc
+	}
+
+	return loc
+}
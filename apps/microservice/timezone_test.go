@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// lateFridayPlays are 20 plays from 23:00 to 23:57 UTC on Friday 6 January
+// 2023, which is Saturday morning in Tokyo.
+func lateFridayPlays(country string) []Track {
+	start := time.Date(2023, 1, 6, 23, 0, 0, 0, time.UTC)
+
+	var tracks []Track
+	for i := 0; i < 20; i++ {
+		track := play(start.Add(time.Duration(i)*3*time.Minute), "Artist A", "Song", "Album", "spotify:track:1")
+		track.ConnCountry = country
+		tracks = append(tracks, track)
+	}
+
+	return tracks
+}
+
+func TestTimezoneMovesTimeBasedStats(t *testing.T) {
+	tests := []struct {
+		timezone string
+		hour     int
+		date     string
+		day      time.Weekday
+	}{
+		{"", 23, "2023-01-06", time.Friday},
+		{"Asia/Tokyo", 8, "2023-01-07", time.Saturday},
+	}
+
+	for _, tt := range tests {
+		result := analyzeTracks(t, lateFridayPlays("DE"), AnalysisOptions{Timezone: tt.timezone})
+
+		if result.PeakHour != tt.hour {
+			t.Errorf("%q: peak hour = %d, want %d", tt.timezone, result.PeakHour, tt.hour)
+		}
+
+		days := result.Heatmap.DailyCounts
+		if len(days) != 1 || days[0].Date != tt.date || days[0].Count != 20 {
+			t.Errorf("%q: heatmap = %+v, want 20 plays on %s", tt.timezone, days, tt.date)
+		}
+
+		if counts := result.WeekdayAnalysis.DayCountMap; len(counts) != 1 || counts[tt.day] != 20 {
+			t.Errorf("%q: weekday counts = %v, want 20 on %s", tt.timezone, counts, tt.day)
+		}
+	}
+}
+
+func TestLatePlayMovesToNextLocalDay(t *testing.T) {
+	late := play(time.Date(2023, 1, 6, 23, 30, 0, 0, time.UTC), "Artist A", "Song", "Album", "spotify:track:1")
+
+	result := analyzeTracks(t, []Track{late}, AnalysisOptions{Timezone: "Europe/Berlin"})
+
+	days := result.Heatmap.DailyCounts
+	if len(days) != 1 || days[0].Date != "2023-01-07" {
+		t.Fatalf("heatmap = %+v, want the play on 2023-01-07", days)
+	}
+	if result.PeakHour != 0 {
+		t.Fatalf("peak hour = %d, want 0", result.PeakHour)
+	}
+}
+
+func TestLongestSessionIsInRequestedZone(t *testing.T) {
+	result := analyzeTracks(t, lateFridayPlays("DE"), AnalysisOptions{Timezone: "Asia/Tokyo"})
+
+	start, _ := result.LongestSession["sessionStart"].(time.Time)
+	end, _ := result.LongestSession["sessionEnd"].(time.Time)
+
+	if start.Location().String() != "Asia/Tokyo" || start.Hour() != 8 || start.Day() != 7 {
+		t.Fatalf("session start = %s, want 08:00 on the 7th in Asia/Tokyo", start)
+	}
+	if end.Location().String() != "Asia/Tokyo" || end.Hour() != 8 || end.Minute() != 57 {
+		t.Fatalf("session end = %s, want 08:57 in Asia/Tokyo", end)
+	}
+}
+
+func TestInferTimezone(t *testing.T) {
+	// Streamed from Japan while living in Berlin.
+	options := AnalysisOptions{Timezone: "Europe/Berlin", InferTimezone: true}
+
+	result := analyzeTracks(t, lateFridayPlays("JP"), options)
+	if result.PeakHour != 8 || result.Heatmap.DailyCounts[0].Date != "2023-01-07" {
+		t.Errorf("plays from JP = peak hour %d on %s, want 8 on 2023-01-07 in Tokyo",
+			result.PeakHour, result.Heatmap.DailyCounts[0].Date)
+	}
+
+	result = analyzeTracks(t, lateFridayPlays("DE"), options)
+	if result.PeakHour != 0 {
+		t.Errorf("plays from DE = peak hour %d, want 0 in Berlin", result.PeakHour)
+	}
+
+	options.InferTimezone = false
+	result = analyzeTracks(t, lateFridayPlays("JP"), options)
+	if result.PeakHour != 0 {
+		t.Errorf("plays from JP without inference = peak hour %d, want 0 in Berlin", result.PeakHour)
+	}
+}
+
+func TestZoneResolverKeepsHomeZoneInOwnCountry(t *testing.T) {
+	zones, err := newZoneResolver(AnalysisOptions{Timezone: "America/Chicago", InferTimezone: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"US": "America/Chicago",
+		"JP": "Asia/Tokyo",
+		"AU": "Australia/Sydney",
+		"XX": "America/Chicago",
+		"":   "America/Chicago",
+	}
+
+	for country, want := range tests {
+		if got := zones.locate(country).String(); got != want {
+			t.Errorf("locate(%q) = %s, want %s", country, got, want)
+		}
+	}
+
+	for country, zones := range countryZones {
+		for _, zone := range zones {
+			if _, err := time.LoadLocation(zone); err != nil {
+				t.Errorf("%s: unknown zone %s", country, zone)
+			}
+		}
+	}
+}
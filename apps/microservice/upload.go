@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Form fields other than the file are small, anything bigger is a bad
+// request rather than something to buffer.
+const maxUploadFieldBytes = 64 << 10
+
+var (
+	ErrInvalidUpload    = errors.New("invalid upload")
+	ErrChecksumMismatch = errors.New("upload checksum does not match")
+)
+
+// Upload is an export posted straight to the service instead of going
+// through S3. The zip is kept under the upload directory until its job is
+// done with it.
+type Upload struct {
+	ProcessID string
+	UserID    string
+	Options   AnalysisOptions
+	Path      string
+	Size      int64
+	SHA256    string
+}
+
+// ReceiveUpload reads a multipart/form-data body with the fields process_id,
+// user_id, sha256 (hex), an optional options field holding the same JSON
+// options /process takes, and the zip itself as file. process_id, user_id
+// and options must come before file: options are validated as soon as they
+// are read, and once the IDs are read admit gets to turn the upload away,
+// so either error is returned before any of the zip is accepted. The zip
+// is streamed to dir while it is hashed, and rejected once it is bigger than
+// the budget's archive or disk limit, so it is never held in memory. On
+// error nothing is left behind in dir.
+func ReceiveUpload(ctx context.Context, body io.Reader, contentType, dir string, budget *JobBudget, admit func(*Upload) error) (*Upload, error) {
+	if body == nil {
+		return nil, fmt.Errorf("%w: empty body", ErrInvalidUpload)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return nil, fmt.Errorf("%w: expected a multipart/form-data body", ErrInvalidUpload)
+	}
+
+	upload := new(Upload)
+	var checksum string
+
+	reader := multipart.NewReader(&contextReader{ctx: ctx, r: body}, params["boundary"])
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			upload.discard()
+			return nil, fmt.Errorf("%w: %w", ErrInvalidUpload, err)
+		}
+
+		switch name := part.FormName(); name {
+		case "file":
+			if upload.Path != "" {
+				err = fmt.Errorf("%w: more than one file", ErrInvalidUpload)
+				break
+			}
+			if upload.ProcessID == "" || upload.UserID == "" {
+				err = fmt.Errorf("%w: process_id and user_id must come before file", ErrInvalidUpload)
+				break
+			}
+			if admit != nil {
+				if err = admit(upload); err != nil {
+					break
+				}
+			}
+			err = upload.save(part, dir, budget)
+		case "process_id":
+			upload.ProcessID, err = readUploadField(part)
+		case "user_id":
+			upload.UserID, err = readUploadField(part)
+		case "sha256":
+			checksum, err = readUploadField(part)
+		case "options":
+			if upload.Path != "" {
+				err = fmt.Errorf("%w: options must come before file", ErrInvalidUpload)
+				break
+			}
+			var value string
+			if value, err = readUploadField(part); err == nil && value != "" {
+				if jsonErr := json.Unmarshal([]byte(value), &upload.Options); jsonErr != nil {
+					err = fmt.Errorf("%w: invalid options: %w", ErrInvalidUpload, jsonErr)
+				} else if optErr := upload.Options.Validate(); optErr != nil {
+					err = fmt.Errorf("%w: %w", ErrInvalidUpload, optErr)
+				}
+			}
+		default:
+			err = fmt.Errorf("%w: unexpected field %q", ErrInvalidUpload, name)
+		}
+
+		// Closing a part reads the rest of it, which for a rejected file is
+		// exactly what shouldn't happen.
+		if err != nil {
+			upload.discard()
+			return nil, err
+		}
+
+		part.Close()
+	}
+
+	if err := upload.verify(checksum); err != nil {
+		upload.discard()
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+func readUploadField(part *multipart.Part) (string, error) {
+	value, err := io.ReadAll(io.LimitReader(part, maxUploadFieldBytes+1))
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidUpload, err)
+	}
+
+	if len(value) > maxUploadFieldBytes {
+		return "", fmt.Errorf("%w: field %q is too large", ErrInvalidUpload, part.FormName())
+	}
+
+	return strings.TrimSpace(string(value)), nil
+}
+
+func (u *Upload) save(part io.Reader, dir string, budget *JobBudget) error {
+	file, err := os.CreateTemp(dir, "upload-*.zip")
+	if err != nil {
+		return fmt.Errorf("failed to create upload file: %w", err)
+	}
+
+	u.Path = file.Name()
+
+	hash := sha256.New()
+	_, err = io.Copy(&budgetWriter{w: io.MultiWriter(file, hash), charge: func(n int64) error {
+		if err := budget.CheckArchive(u.Size + n); err != nil {
+			return err
+		}
+		u.Size += n
+		return budget.AddDisk(n)
+	}}, part)
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	var limitErr *LimitError
+	if err != nil && !errors.As(err, &limitErr) {
+		err = fmt.Errorf("%w: failed to read file: %w", ErrInvalidUpload, err)
+	}
+
+	u.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	return err
+}
+
+func (u *Upload) verify(checksum string) error {
+	switch {
+	case u.Path == "":
+		return fmt.Errorf("%w: missing file", ErrInvalidUpload)
+	case u.Size == 0:
+		return fmt.Errorf("%w: file is empty", ErrInvalidUpload)
+	case checksum == "":
+		return fmt.Errorf("%w: missing sha256", ErrInvalidUpload)
+	case !strings.EqualFold(checksum, u.SHA256):
+		return fmt.Errorf("%w: got %s", ErrChecksumMismatch, u.SHA256)
+	}
+
+	return nil
+}
+
+// discard removes the saved zip, for when the upload is rejected or its job
+// could not be queued.
+func (u *Upload) discard() {
+	if u.Path != "" {
+		os.Remove(u.Path)
+	}
+}
+
+// Job returns the job that processes the upload.
+func (u *Upload) Job() *Job {
+	return &Job{
+		ProcessID: u.ProcessID,
+		UserID:    u.UserID,
+		Options:   u.Options,
+		Upload:    filepath.Base(u.Path),
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime/multipart"
+	"os"
+	"testing"
+)
+
+type uploadPart struct {
+	name  string
+	value string
+}
+
+// uploadBody encodes parts as a multipart/form-data body in the given
+// order. The part named file is sent as a file.
+func uploadBody(t *testing.T, parts ...uploadPart) (*bytes.Buffer, string) {
+	t.Helper()
+
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+
+	for _, part := range parts {
+		var w io.Writer
+		var err error
+		if part.name == "file" {
+			w, err = form.CreateFormFile("file", "export.zip")
+		} else {
+			w, err = form.CreateFormField(part.name)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, part.value)
+	}
+
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return body, form.FormDataContentType()
+}
+
+func checksum(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func assertEmptyDir(t *testing.T, dir string) {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("%d files left behind in the upload dir", len(entries))
+	}
+}
+
+func TestReceiveUpload(t *testing.T) {
+	dir := t.TempDir()
+	zip := "not really a zip"
+
+	body, contentType := uploadBody(t,
+		uploadPart{"process_id", "p1"},
+		uploadPart{"user_id", "u1"},
+		uploadPart{"options", `{"timezone": "Europe/Berlin"}`},
+		uploadPart{"sha256", checksum(zip)},
+		uploadPart{"file", zip},
+	)
+
+	var admitted *Upload
+	upload, err := ReceiveUpload(context.Background(), body, contentType, dir, nil, func(u *Upload) error {
+		admitted = u
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upload.discard()
+
+	if admitted == nil || admitted.ProcessID != "p1" || admitted.UserID != "u1" {
+		t.Fatalf("admit was called with %+v, want p1 for u1", admitted)
+	}
+
+	data, err := os.ReadFile(upload.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != zip || upload.Size != int64(len(zip)) || upload.SHA256 != checksum(zip) {
+		t.Fatalf("saved %q (%d bytes, %s), want the posted file", data, upload.Size, upload.SHA256)
+	}
+	if upload.Options.Timezone != "Europe/Berlin" {
+		t.Fatalf("options = %+v, want the posted options", upload.Options)
+	}
+}
+
+func TestReceiveUploadWantsIDsBeforeFile(t *testing.T) {
+	dir := t.TempDir()
+	zip := "not really a zip"
+
+	body, contentType := uploadBody(t,
+		uploadPart{"process_id", "p1"},
+		uploadPart{"file", zip},
+		uploadPart{"user_id", "u1"},
+		uploadPart{"sha256", checksum(zip)},
+	)
+
+	_, err := ReceiveUpload(context.Background(), body, contentType, dir, nil, nil)
+	if !errors.Is(err, ErrInvalidUpload) {
+		t.Fatalf("upload with user_id after file = %v, want ErrInvalidUpload", err)
+	}
+
+	assertEmptyDir(t, dir)
+}
+
+// unreadable fails the test's upload if the zip is read at all.
+type unreadable struct{}
+
+func (unreadable) Read(p []byte) (int, error) {
+	return 0, errors.New("file body was read")
+}
+
+func TestReceiveUploadRejectsBeforeReadingFile(t *testing.T) {
+	dir := t.TempDir()
+
+	// Cut the body off right after the file part's headers, where the zip
+	// would start.
+	head, contentType := uploadBody(t,
+		uploadPart{"process_id", "p1"},
+		uploadPart{"user_id", "u1"},
+		uploadPart{"file", "PK"},
+	)
+	cut := bytes.Index(head.Bytes(), []byte("PK"))
+	body := io.MultiReader(bytes.NewReader(head.Bytes()[:cut]), unreadable{})
+
+	_, err := ReceiveUpload(context.Background(), body, contentType, dir, nil, func(*Upload) error {
+		return ErrQueueFull
+	})
+	if !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("rejected upload = %v, want the admit error", err)
+	}
+
+	assertEmptyDir(t, dir)
+}